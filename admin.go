@@ -0,0 +1,41 @@
+package command
+
+import (
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI serves the admin endpoints of the module:
+//
+//   - /exec/history: the history of the commands with KeepHistory
+//   - /exec/executions/: the running executions of the commands with
+//     AllowAttach, and their output at /exec/executions/<id>
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.exec",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/exec/history",
+			Handler: caddy.AdminHandlerFunc(serveHistory),
+		},
+		{
+			Pattern: "/exec/executions/",
+			Handler: caddy.AdminHandlerFunc(serveExecutions),
+		},
+	}
+}
+
+// Interface guards
+var _ caddy.AdminRouter = (*adminAPI)(nil)
@@ -1,6 +1,8 @@
 package command
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"sync/atomic"
 
@@ -10,10 +12,11 @@ import (
 
 // Interface guards
 var (
-	_ caddy.App         = (*App)(nil)
-	_ caddy.Module      = (*App)(nil)
-	_ caddy.Provisioner = (*App)(nil)
-	_ caddy.Validator   = (*App)(nil)
+	_ caddy.App          = (*App)(nil)
+	_ caddy.Module       = (*App)(nil)
+	_ caddy.Provisioner  = (*App)(nil)
+	_ caddy.Validator    = (*App)(nil)
+	_ caddy.CleanerUpper = (*App)(nil)
 )
 
 // lifeCycle is used to keep track of startup/shutdown
@@ -30,7 +33,12 @@ func init() {
 type App struct {
 	Commands []Cmd `json:"commands,omitempty"`
 
+	// Pools maps pool names to the maximum number of processes running
+	// at once across all the commands that reference the pool.
+	Pools map[string]int `json:"pools,omitempty"`
+
 	commands map[string][]Runner
+	pools    map[string]*pool
 	log      *zap.Logger
 }
 
@@ -41,20 +49,28 @@ func (a *App) Provision(ctx caddy.Context) error {
 	}
 
 	a.log = ctx.Logger(a)
+
+	a.pools = make(map[string]*pool, len(a.Pools))
+	for name, size := range a.Pools {
+		a.pools[name] = newPool(size)
+	}
+
 	repl := caddy.NewReplacer()
-	for _, cmd := range a.Commands {
+	for i := range a.Commands {
+		cmd := &a.Commands[i]
 		if err := cmd.provision(ctx, a); err != nil {
 			return err
 		}
 
 		// replace global placeholders
+		cmd.Command = cmd.replaceCommand(repl)
 		argv := make([]string, len(cmd.Args))
 		for index, argument := range cmd.Args {
 			argv[index] = repl.ReplaceAll(argument, "")
 		}
 
 		runner := runnerFunc(func() error {
-			return cmd.run(argv)
+			return cmd.run(context.Background(), argv)
 		})
 
 		for at := range cmd.at {
@@ -66,7 +82,19 @@ func (a *App) Provision(ctx caddy.Context) error {
 
 // Validate implements caddy.Validator
 func (a App) Validate() error {
+	for name, size := range a.Pools {
+		if size < 1 {
+			return fmt.Errorf("pool '%s' must allow at least one process", name)
+		}
+	}
+
 	for _, cmd := range a.Commands {
+		if len(cmd.Steps) > 0 {
+			return fmt.Errorf("steps are only supported by the HTTP handler")
+		}
+		if len(cmd.PipeTo) > 0 {
+			return fmt.Errorf("pipe_to is only supported by the HTTP handler")
+		}
 		if err := cmd.validate(); err != nil {
 			return err
 		}
@@ -75,6 +103,14 @@ func (a App) Validate() error {
 	return nil
 }
 
+// Cleanup implements caddy.CleanerUpper
+func (a *App) Cleanup() error {
+	for i := range a.Commands {
+		a.Commands[i].cleanup()
+	}
+	return nil
+}
+
 // Start starts the app.
 func (a App) Start() error {
 	count := atomic.AddInt32(&lifeCycle, 1)
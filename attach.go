@@ -0,0 +1,232 @@
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// attachRecentLines is the number of recent lines of output kept per
+// execution with AllowAttach, sent first to the attached clients.
+const attachRecentLines = 100
+
+// attachBuffer is the number of lines buffered per attached client,
+// lines are dropped for clients that do not keep up.
+const attachBuffer = 256
+
+// outputLine is a line of output of an execution.
+type outputLine struct {
+	stream string
+	text   string
+}
+
+// execution is a running execution of a command with AllowAttach, whose
+// output is fanned out to the attached clients.
+type execution struct {
+	command string
+	started time.Time
+	streams int // output streams still written to
+
+	mu     sync.Mutex
+	recent []outputLine // ring of the last attachRecentLines lines
+	next   int          // index of the oldest line once full
+	subs   map[chan outputLine]struct{}
+	done   chan struct{}
+}
+
+// executions are the running executions with AllowAttach by ID.
+var executions = struct {
+	mu sync.Mutex
+	m  map[string]*execution
+}{m: map[string]*execution{}}
+
+// publish sends line to the attached clients.
+func (e *execution) publish(line outputLine) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.recent) < attachRecentLines {
+		e.recent = append(e.recent, line)
+	} else {
+		e.recent[e.next] = line
+		e.next = (e.next + 1) % attachRecentLines
+	}
+	for sub := range e.subs {
+		// the command must not wait for the attached clients
+		select {
+		case sub <- line:
+		default:
+		}
+	}
+}
+
+// subscribe returns the recent lines and a channel receiving the next
+// ones, until unsubscribe is called.
+func (e *execution) subscribe() (recent []outputLine, lines chan outputLine) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	recent = append(recent, e.recent[e.next:]...)
+	recent = append(recent, e.recent[:e.next]...)
+	lines = make(chan outputLine, attachBuffer)
+	e.subs[lines] = struct{}{}
+	return recent, lines
+}
+
+func (e *execution) unsubscribe(lines chan outputLine) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.subs, lines)
+}
+
+// lineTap splits the output written to it into lines published to an
+// execution.
+type lineTap struct {
+	e       *execution
+	stream  string
+	pending []byte
+}
+
+func (t *lineTap) Write(p []byte) (int, error) {
+	t.pending = append(t.pending, p...)
+	for {
+		i := bytes.IndexByte(t.pending, '\n')
+		if i < 0 {
+			break
+		}
+		t.e.publish(outputLine{t.stream, strings.TrimSuffix(string(t.pending[:i]), "\r")})
+		t.pending = t.pending[i+1:]
+	}
+	return len(p), nil
+}
+
+// tapOutput returns w with the output also published to the clients
+// attached to the execution id if AllowAttach is set, and a function
+// publishing the last line of output to call once the command exited.
+func (c *Cmd) tapOutput(w io.Writer, id, stream string) (io.Writer, func()) {
+	if !c.AllowAttach {
+		return w, func() {}
+	}
+
+	executions.mu.Lock()
+	e, ok := executions.m[id]
+	if !ok {
+		e = &execution{
+			command: c.Command,
+			started: time.Now(),
+			subs:    map[chan outputLine]struct{}{},
+			done:    make(chan struct{}),
+		}
+		executions.m[id] = e
+	}
+	e.streams++
+	executions.mu.Unlock()
+
+	tap := &lineTap{e: e, stream: stream}
+	done := func() {
+		if len(tap.pending) > 0 {
+			e.publish(outputLine{stream, string(tap.pending)})
+		}
+
+		executions.mu.Lock()
+		defer executions.mu.Unlock()
+		e.streams--
+		if e.streams == 0 {
+			delete(executions.m, id)
+			close(e.done)
+		}
+	}
+	if w == nil {
+		return tap, done
+	}
+	return io.MultiWriter(w, tap), done
+}
+
+// mirrorOutput returns w with the output also mirrored to syslog and
+// published to attached clients, if enabled, and a function to call once
+// the command exited.
+func (c *Cmd) mirrorOutput(w io.Writer, id, stream string) (io.Writer, func()) {
+	w, untap := c.tapOutput(w, id, stream)
+	w, flush := c.mirrorToSyslog(w, id, stream)
+	return w, func() {
+		flush()
+		untap()
+	}
+}
+
+// serveExecutions lists the running executions at /exec/executions/, and
+// streams the output of an execution at /exec/executions/<id> as
+// Server-Sent Events until it completes or the client goes away.
+func serveExecutions(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/exec/executions/")
+	if id == "" {
+		type runningExecution struct {
+			ID      string    `json:"id"`
+			Command string    `json:"command"`
+			Started time.Time `json:"started"`
+		}
+		resp := []runningExecution{}
+		executions.mu.Lock()
+		for id, e := range executions.m {
+			resp = append(resp, runningExecution{id, e.command, e.started})
+		}
+		executions.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(resp)
+	}
+
+	executions.mu.Lock()
+	e, ok := executions.m[id]
+	executions.mu.Unlock()
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no running execution '%s'", id),
+		}
+	}
+
+	recent, lines := e.subscribe()
+	defer e.unsubscribe(lines)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, line := range recent {
+		writeEvent(w, line.stream, line.text)
+	}
+	rc.Flush()
+
+	for {
+		select {
+		case line := <-lines:
+			writeEvent(w, line.stream, line.text)
+			rc.Flush()
+		case <-e.done:
+			// the last lines are published before completion, they
+			// may still be buffered.
+			for len(lines) > 0 {
+				line := <-lines
+				writeEvent(w, line.stream, line.text)
+			}
+			fmt.Fprintf(w, "event: close\ndata: Command finished\n\n")
+			rc.Flush()
+			return nil
+		case <-r.Context().Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package command
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAttachLastLinesBeforeClose(t *testing.T) {
+	const id = "test-attach-last-lines"
+	e := &execution{
+		command: "test",
+		started: time.Now(),
+		subs:    map[chan outputLine]struct{}{},
+		done:    make(chan struct{}),
+	}
+	executions.mu.Lock()
+	executions.m[id] = e
+	executions.mu.Unlock()
+
+	w := httptest.NewRecorder()
+	served := make(chan error, 1)
+	go func() {
+		served <- serveExecutions(w, httptest.NewRequest(http.MethodGet, "/exec/executions/"+id, nil))
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		e.mu.Lock()
+		attached := len(e.subs) > 0
+		e.mu.Unlock()
+		if attached {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the client did not attach")
+		}
+	}
+
+	// the execution completes right after its last lines
+	for i := range attachBuffer {
+		e.publish(outputLine{"stdout", fmt.Sprintf("line %d", i)})
+	}
+	executions.mu.Lock()
+	delete(executions.m, id)
+	close(e.done)
+	executions.mu.Unlock()
+
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	body := w.Body.String()
+	last := strings.Index(body, fmt.Sprintf("data: line %d\n", attachBuffer-1))
+	if last < 0 || last > strings.Index(body, "event: close") {
+		t.Errorf("the last line is not sent before close:\n%s", body[max(0, len(body)-200):])
+	}
+}
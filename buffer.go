@@ -0,0 +1,46 @@
+package command
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+// errOutputLimit is returned by limitedBuffer once the limit is exceeded,
+// it makes exec stop reading the output and close the pipe.
+var errOutputLimit = errors.New("output limit exceeded")
+
+// limitedBuffer collects up to limit bytes of output.
+type limitedBuffer struct {
+	mu       sync.Mutex // for snapshots while the command runs
+	buf      bytes.Buffer
+	limit    int64 // 0 for no limit
+	exceeded bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 {
+		if remaining := b.limit - int64(b.buf.Len()); remaining < int64(len(p)) {
+			n, _ := b.buf.Write(p[:remaining])
+			b.exceeded = true
+			return n, errOutputLimit
+		}
+	}
+	return b.buf.Write(p)
+}
+
+// snapshot returns a copy of the output collected so far, and whether
+// it was truncated.
+func (b *limitedBuffer) snapshot() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf.Bytes()), b.exceeded
+}
+
+// isTruncationError reports whether err is caused by the pipe closed
+// after the output limit was exceeded, rather than a command failure.
+func isTruncationError(err error) bool {
+	return errors.Is(err, errOutputLimit) || killedBySIGPIPE(err)
+}
@@ -2,12 +2,14 @@ package command
 
 import (
 	"encoding/json"
+	"strconv"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
 )
 
 func init() {
@@ -16,7 +18,7 @@ func init() {
 }
 
 func newCommandFromDispenser(d *caddyfile.Dispenser) (cmd Cmd, err error) {
-	cmd.UnmarshalCaddyfile(d)
+	err = cmd.UnmarshalCaddyfile(d)
 	return
 }
 
@@ -26,13 +28,64 @@ func newCommandFromDispenser(d *caddyfile.Dispenser) (cmd Cmd, err error) {
 //	  exec [<matcher>] [<command> [<args...>]] {
 //	    command     <text>
 //	    args        <text>...
+//	    step        <command> [<args...>] {
+//	      <command options...>
+//	    }
+//	    continue_on_error
+//	    pipe_to     <command> [<args...>]
 //	    directory   <text>
+//	    read_only_root [<writable paths...>]
+//	    login_shell [<shell>]
+//	    require_absolute_path
 //	    timeout     <duration>
+//	    request_to_stdin [<body limit>] {
+//	      exclude_headers <header...>
+//	    }
+//	    stdin_file  <path> [<root>]
+//	    body_to_temp_file [<body limit>] {
+//	      temp_dir <dir>
+//	    }
+//	    input_encoding <charset>
+//	    probe       [<expect regexp>]
+//	    probe_cache <duration>
+//	    probe_timeout <duration>
+//	    debounce    <duration> [<max_wait>]
+//	    cooldown    <duration> [<status>]
+//	    heartbeat   <duration> [json|whitespace]
 //	    log         <log output module>
 //	    err_log     <log output module>
+//	    log_sample  <n>
+//	    keep_history <n>
+//	    allow_attach
+//	    syslog      <address> [<tag>]
+//	    forward_signals <signal...>
+//	    correlation_env <id name> [<traceparent name>]
+//	    unset_env   <name...>
+//	    claim_env   <claim> <name>
+//	    start_retries <count> [<error...>]
+//	    pool        <name>
+//	    max_identical <count> [wait|reject]
+//	    lock_key    <key> [<timeout>]
 //	    foreground
 //	    pass_thru
+//	    cancel_on_disconnect
+//	    success_status <status>
+//	    max_output  <size>
+//	    output_lines
 //	    stream
+//	    stream_after <duration>
+//	    response_deadline <duration> [continue|kill]
+//	    framing     sse|length-prefixed
+//	    duplex
+//	    line_gap_metrics
+//	    metadata_frame
+//	    stats_interval <duration>
+//	    line_template <template>
+//	    exit_code_event <code> <event>
+//	    exit_code_only
+//	    exit_code_status <code> <status>
+//	    stderr_fails
+//	    exit_semantics default|grep|diff|custom [<code...>]
 //	    startup
 //	    shutdown
 //	}
@@ -44,16 +97,66 @@ func parseHandlerCaddyfileBlock(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHan
 // parseGlobalCaddyfileBlock configures the "exec" global option from Caddyfile.
 // Syntax:
 //
+//	  exec pool <name> <size>
+//
+//	  or
+//
 //	  exec [<command> [<args...>]] {
 //	    command     <text>...
 //	    args        <text>...
 //	    directory   <text>
+//	    read_only_root [<writable paths...>]
+//	    login_shell [<shell>]
+//	    require_absolute_path
 //	    timeout     <duration>
+//	    request_to_stdin [<body limit>] {
+//	      exclude_headers <header...>
+//	    }
+//	    stdin_file  <path> [<root>]
+//	    body_to_temp_file [<body limit>] {
+//	      temp_dir <dir>
+//	    }
+//	    input_encoding <charset>
+//	    probe       [<expect regexp>]
+//	    probe_cache <duration>
+//	    probe_timeout <duration>
+//	    debounce    <duration> [<max_wait>]
+//	    cooldown    <duration> [<status>]
+//	    heartbeat   <duration> [json|whitespace]
 //	    log         <log output module>
 //	    err_log     <log output module>
+//	    log_sample  <n>
+//	    keep_history <n>
+//	    allow_attach
+//	    syslog      <address> [<tag>]
+//	    forward_signals <signal...>
+//	    correlation_env <id name> [<traceparent name>]
+//	    unset_env   <name...>
+//	    claim_env   <claim> <name>
+//	    start_retries <count> [<error...>]
+//	    pool        <name>
+//	    max_identical <count> [wait|reject]
+//	    lock_key    <key> [<timeout>]
 //	    foreground
 //	    pass_thru
+//	    cancel_on_disconnect
+//	    success_status <status>
+//	    max_output  <size>
+//	    output_lines
 //	    stream
+//	    stream_after <duration>
+//	    response_deadline <duration> [continue|kill]
+//	    framing     sse|length-prefixed
+//	    duplex
+//	    line_gap_metrics
+//	    metadata_frame
+//	    stats_interval <duration>
+//	    line_template <template>
+//	    exit_code_event <code> <event>
+//	    exit_code_only
+//	    exit_code_status <code> <status>
+//	    stderr_fails
+//	    exit_semantics default|grep|diff|custom [<code...>]
 //	    startup
 //	    shutdown
 //	}
@@ -69,19 +172,36 @@ func parseGlobalCaddyfileBlock(d *caddyfile.Dispenser, prev interface{}) (interf
 		}
 	}
 
-	cmd, err := newCommandFromDispenser(d)
-	if err != nil {
-		return nil, err
-	}
+	if d.NextArg() && d.NextArg() && d.Val() == "pool" {
+		// a pool declaration instead of a command.
+		var name, size string
+		if !d.Args(&name, &size) || d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			return nil, d.Errf("invalid pool size '%s': %v", size, err)
+		}
+		if exec.Pools == nil {
+			exec.Pools = map[string]int{}
+		}
+		exec.Pools[name] = n
+	} else {
+		d.Reset()
+		cmd, err := newCommandFromDispenser(d)
+		if err != nil {
+			return nil, err
+		}
 
-	// global block commands are not necessarily bound to a route,
-	// should default to running at startup.
-	if len(cmd.At) == 0 {
-		cmd.At = append(cmd.At, "startup")
-	}
+		// global block commands are not necessarily bound to a route,
+		// should default to running at startup.
+		if len(cmd.At) == 0 {
+			cmd.At = append(cmd.At, "startup")
+		}
 
-	// append command to global exec app.
-	exec.Commands = append(exec.Commands, cmd)
+		// append command to global exec app.
+		exec.Commands = append(exec.Commands, cmd)
+	}
 
 	// tell Caddyfile adapter that this is the JSON for an app
 	return httpcaddyfile.App{
@@ -96,13 +216,64 @@ func parseGlobalCaddyfileBlock(d *caddyfile.Dispenser, prev interface{}) (interf
 //	  exec [<matcher>] [<command> [<args...>]] {
 //	    command     <text>
 //	    args        <text>...
+//	    step        <command> [<args...>] {
+//	      <command options...>
+//	    }
+//	    continue_on_error
+//	    pipe_to     <command> [<args...>]
 //	    directory   <text>
+//	    read_only_root [<writable paths...>]
+//	    login_shell [<shell>]
+//	    require_absolute_path
 //	    timeout     <duration>
+//	    request_to_stdin [<body limit>] {
+//	      exclude_headers <header...>
+//	    }
+//	    stdin_file  <path> [<root>]
+//	    body_to_temp_file [<body limit>] {
+//	      temp_dir <dir>
+//	    }
+//	    input_encoding <charset>
+//	    probe       [<expect regexp>]
+//	    probe_cache <duration>
+//	    probe_timeout <duration>
+//	    debounce    <duration> [<max_wait>]
+//	    cooldown    <duration> [<status>]
+//	    heartbeat   <duration> [json|whitespace]
 //	    log         <log output module>
 //	    err_log     <log output module>
+//	    log_sample  <n>
+//	    keep_history <n>
+//	    allow_attach
+//	    syslog      <address> [<tag>]
+//	    forward_signals <signal...>
+//	    correlation_env <id name> [<traceparent name>]
+//	    unset_env   <name...>
+//	    claim_env   <claim> <name>
+//	    start_retries <count> [<error...>]
+//	    pool        <name>
+//	    max_identical <count> [wait|reject]
+//	    lock_key    <key> [<timeout>]
 //	    foreground
 //	    pass_thru
+//	    cancel_on_disconnect
+//	    success_status <status>
+//	    max_output  <size>
+//	    output_lines
 //	    stream
+//	    stream_after <duration>
+//	    response_deadline <duration> [continue|kill]
+//	    framing     sse|length-prefixed
+//	    duplex
+//	    line_gap_metrics
+//	    metadata_frame
+//	    stats_interval <duration>
+//	    line_template <template>
+//	    exit_code_event <code> <event>
+//	    exit_code_only
+//	    exit_code_status <code> <status>
+//	    stderr_fails
+//	    exit_semantics default|grep|diff|custom [<code...>]
 //	    startup
 //	    shutdown
 //	}
@@ -120,7 +291,7 @@ func (c *Cmd) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 }
 
 func (c *Cmd) unmarshalBlock(d *caddyfile.Dispenser) error {
-	for d.NextBlock(0) {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
 		switch d.Val() {
 		case "command":
 			if c.Command != "" {
@@ -135,16 +306,150 @@ func (c *Cmd) unmarshalBlock(d *caddyfile.Dispenser) error {
 				return d.Err("args specified twice")
 			}
 			c.Args = d.RemainingArgs()
+		case "pipe_to":
+			c.PipeTo = d.RemainingArgs()
+			if len(c.PipeTo) == 0 {
+				return d.ArgErr()
+			}
+		case "step":
+			var step Cmd
+			if !d.Args(&step.Command) {
+				return d.ArgErr()
+			}
+			step.Args = d.RemainingArgs()
+			if err := step.unmarshalBlock(d); err != nil {
+				return err
+			}
+			c.Steps = append(c.Steps, step)
+		case "continue_on_error":
+			c.ContinueOnError = true
 		case "directory":
 			if !d.Args(&c.Directory) {
 				return d.ArgErr()
 			}
+		case "read_only_root":
+			c.ReadOnlyRoot = true
+			c.WritablePaths = append(c.WritablePaths, d.RemainingArgs()...)
+		case "login_shell":
+			c.LoginShell = true
+			if d.NextArg() {
+				c.LoginShellPath = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "require_absolute_path":
+			c.RequireAbsolutePath = true
 		case "foreground":
 			c.Foreground = true
+		case "output_lines":
+			c.OutputLines = true
 		case "pass_thru":
 			c.PassThru = true
+		case "max_output":
+			var limit string
+			if !d.Args(&limit) {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(limit)
+			if err != nil {
+				return d.Errf("invalid size '%s': %v", limit, err)
+			}
+			c.MaxOutput = int64(size)
+		case "success_status":
+			var status string
+			if !d.Args(&status) {
+				return d.ArgErr()
+			}
+			code, err := strconv.Atoi(status)
+			if err != nil {
+				return d.Errf("invalid status '%s': %v", status, err)
+			}
+			c.SuccessStatus = code
 		case "stream":
 			c.Stream = true
+		case "cancel_on_disconnect":
+			c.CancelOnDisconnect = true
+		case "line_gap_metrics":
+			c.LineGapMetrics = true
+		case "stream_after":
+			if !d.Args(&c.StreamAfter) {
+				return d.ArgErr()
+			}
+		case "response_deadline":
+			if !d.Args(&c.ResponseDeadline) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				c.ResponseDeadlineAction = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "duplex":
+			c.Duplex = true
+		case "framing":
+			if !d.Args(&c.Framing) {
+				return d.ArgErr()
+			}
+		case "line_template":
+			if !d.Args(&c.LineTemplate) {
+				return d.ArgErr()
+			}
+		case "exit_code_event":
+			var code, event string
+			if !d.Args(&code, &event) {
+				return d.ArgErr()
+			}
+			exitCode, err := strconv.Atoi(code)
+			if err != nil {
+				return d.Errf("invalid exit code '%s': %v", code, err)
+			}
+			if c.ExitCodeEvents == nil {
+				c.ExitCodeEvents = map[int]string{}
+			}
+			c.ExitCodeEvents[exitCode] = event
+		case "exit_code_only":
+			c.ExitCodeOnly = true
+		case "stderr_fails":
+			c.StderrFails = true
+		case "exit_code_status":
+			var code, status string
+			if !d.Args(&code, &status) {
+				return d.ArgErr()
+			}
+			exitCode, err := strconv.Atoi(code)
+			if err != nil {
+				return d.Errf("invalid exit code '%s': %v", code, err)
+			}
+			httpStatus, err := strconv.Atoi(status)
+			if err != nil {
+				return d.Errf("invalid status '%s': %v", status, err)
+			}
+			if c.ExitCodeStatuses == nil {
+				c.ExitCodeStatuses = map[int]int{}
+			}
+			c.ExitCodeStatuses[exitCode] = httpStatus
+		case "stats_interval":
+			if !d.Args(&c.StatsInterval) {
+				return d.ArgErr()
+			}
+		case "metadata_frame":
+			c.MetadataFrame = true
+		case "allow_attach":
+			c.AllowAttach = true
+		case "exit_semantics":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.ExitSemantics = d.Val()
+			for d.NextArg() {
+				code, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid exit code '%s': %v", d.Val(), err)
+				}
+				c.SuccessExitCodes = append(c.SuccessExitCodes, code)
+			}
 		case "startup":
 			c.At = append(c.At, "startup")
 		case "shutdown":
@@ -153,6 +458,220 @@ func (c *Cmd) unmarshalBlock(d *caddyfile.Dispenser) error {
 			if !d.Args(&c.Timeout) {
 				return d.ArgErr()
 			}
+		case "request_to_stdin":
+			c.RequestToStdin = true
+			if d.NextArg() {
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("invalid body limit '%s': %v", d.Val(), err)
+				}
+				c.RequestBodyLimit = int64(size)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "exclude_headers":
+					c.RequestExcludeHeaders = append(c.RequestExcludeHeaders, d.RemainingArgs()...)
+				default:
+					return d.Errf("'%s' not expected", d.Val())
+				}
+			}
+		case "body_to_temp_file":
+			c.BodyToTempFile = true
+			if d.NextArg() {
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("invalid body limit '%s': %v", d.Val(), err)
+				}
+				c.RequestBodyLimit = int64(size)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "temp_dir":
+					if !d.Args(&c.TempDir) {
+						return d.ArgErr()
+					}
+				default:
+					return d.Errf("'%s' not expected", d.Val())
+				}
+			}
+		case "probe":
+			c.Probe = true
+			if d.NextArg() {
+				c.ProbeExpect = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "probe_cache":
+			if !d.Args(&c.ProbeCache) {
+				return d.ArgErr()
+			}
+		case "probe_timeout":
+			if !d.Args(&c.ProbeTimeout) {
+				return d.ArgErr()
+			}
+		case "debounce":
+			if !d.Args(&c.Debounce) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				c.DebounceMaxWait = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "heartbeat":
+			if !d.Args(&c.Heartbeat) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				c.HeartbeatFormat = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "syslog":
+			if !d.Args(&c.SyslogAddr) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				c.SyslogTag = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "forward_signals":
+			c.ForwardSignals = append(c.ForwardSignals, d.RemainingArgs()...)
+			if len(c.ForwardSignals) == 0 {
+				return d.ArgErr()
+			}
+		case "correlation_env":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.CorrelationIDEnv = d.Val()
+			if d.NextArg() {
+				c.TraceparentEnv = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "claim_env":
+			var claim, name string
+			if !d.Args(&claim, &name) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if c.ClaimsToEnv == nil {
+				c.ClaimsToEnv = map[string]string{}
+			}
+			c.ClaimsToEnv[claim] = name
+		case "unset_env":
+			c.UnsetEnv = append(c.UnsetEnv, d.RemainingArgs()...)
+			if len(c.UnsetEnv) == 0 {
+				return d.ArgErr()
+			}
+		case "start_retries":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			retries, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid start_retries '%s': %v", d.Val(), err)
+			}
+			c.StartRetries = retries
+			c.StartRetryErrors = append(c.StartRetryErrors, d.RemainingArgs()...)
+		case "log_sample":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid log_sample '%s': %v", d.Val(), err)
+			}
+			c.LogSample = n
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "keep_history":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid keep_history '%s': %v", d.Val(), err)
+			}
+			c.KeepHistory = n
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "cooldown":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Cooldown = d.Val()
+			if d.NextArg() {
+				status, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid status '%s': %v", d.Val(), err)
+				}
+				c.CooldownStatus = status
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "max_identical":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			count, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_identical '%s': %v", d.Val(), err)
+			}
+			c.MaxIdentical = count
+			if d.NextArg() {
+				c.IdenticalOverflow = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "lock_key":
+			if !d.Args(&c.LockKey) {
+				return d.ArgErr()
+			}
+			if d.NextArg() {
+				c.LockTimeout = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "pool":
+			if !d.Args(&c.Pool) {
+				return d.ArgErr()
+			}
+		case "stdin_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.StdinFile = d.Val()
+			if d.NextArg() {
+				c.StdinFileRoot = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "input_encoding":
+			if !d.Args(&c.InputEncoding) {
+				return d.ArgErr()
+			}
 		case "log":
 			rawMessage, err := c.unmarshalLog(d)
 			if err != nil {
@@ -0,0 +1,37 @@
+package command
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func TestParseHandlerCaddyfileBlockError(t *testing.T) {
+	for _, input := range []string{
+		"exec echo {\n unknown_option\n require_absolute_path\n}",
+		"exec echo {\n timeout\n}",
+		"exec echo {\n keep_history many\n}",
+	} {
+		h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+		if _, err := parseHandlerCaddyfileBlock(h); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestParseHandlerCaddyfileBlock(t *testing.T) {
+	input := "exec /bin/echo hello {\n foreground\n require_absolute_path\n}"
+	h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+	handler, err := parseHandlerCaddyfileBlock(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := handler.(Middleware)
+	if m.Command != "/bin/echo" || len(m.Args) != 1 || m.Args[0] != "hello" {
+		t.Errorf("unexpected command %q %q", m.Command, m.Args)
+	}
+	if !m.Foreground || !m.RequireAbsolutePath {
+		t.Errorf("options after the command are not parsed: %+v", m.Cmd)
+	}
+}
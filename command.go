@@ -4,25 +4,82 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
 )
 
 // Cmd is the module configuration
 type Cmd struct {
-	// The command to run.
+	// The command to run. Placeholders are replaced when the command
+	// runs, e.g. {http.vars.*} set by preceding handlers.
 	Command string `json:"command,omitempty"`
 
 	// The command args.
 	Args []string `json:"args,omitempty"`
 
+	// PipeTo is a second command and its args, reading the standard
+	// output of the command on its standard input as in a shell pipeline,
+	// but without a shell. Its standard output is collected in place of
+	// the one of the command, their standard error is collected together.
+	// Only supported by foreground commands of the HTTP handler, the
+	// timeout and cancellation apply to both commands.
+	PipeTo []string `json:"pipe_to,omitempty"`
+
+	// RequireAbsolutePath rejects commands that are not absolute paths
+	// instead of looking them up in PATH, so that a directory writable by
+	// others earlier in PATH cannot shadow them. Commands with
+	// placeholders are checked once replaced, and requests for a relative
+	// command are responded with 403. Also applies to the steps.
+	RequireAbsolutePath bool `json:"require_absolute_path,omitempty"`
+
+	// Steps are commands to run in order instead of the command.
+	// Only supported by the HTTP handler, steps always run in the
+	// foreground and the response contains the result of each step.
+	Steps []Cmd `json:"steps,omitempty"`
+
+	// If the remaining steps should run after a step failed.
+	// By default, the sequence is aborted at the first failed step.
+	ContinueOnError bool `json:"continue_on_error,omitempty"`
+
 	// The directory to run the command from.
 	// Defaults to current directory.
 	Directory string `json:"directory,omitempty"`
 
+	// ReadOnlyRoot runs the command in a mount namespace where the
+	// filesystem is read-only, except for WritablePaths and the /dev,
+	// /proc and /sys pseudo filesystems. Only supported on Linux and
+	// requires Caddy to have the CAP_SYS_ADMIN capability. Ignored with
+	// a warning on other platforms.
+	ReadOnlyRoot bool `json:"read_only_root,omitempty"`
+
+	// Absolute paths that remain writable with ReadOnlyRoot.
+	WritablePaths []string `json:"writable_paths,omitempty"`
+
+	// LoginShell runs the command through a login shell, so that the
+	// shell profiles are sourced, e.g. for environments set up there.
+	// The command and its args are passed to the shell as positional
+	// parameters, they are not parsed by the shell.
+	LoginShell bool `json:"login_shell,omitempty"`
+
+	// The login shell to run the command with LoginShell, one of sh,
+	// ash, dash, bash, ksh or zsh, or a path to one. Defaults to "bash".
+	LoginShellPath string `json:"login_shell_path,omitempty"`
+
 	// If the command should run in the foreground.
 	// By default, commands run in the background and doesn't
 	// affects Caddy.
@@ -34,6 +91,130 @@ type Cmd struct {
 	// Stream enables Server-Sent Events streaming of command output.
 	Stream bool `json:"stream,omitempty"`
 
+	// StreamAfter is a grace period for HTTP triggered commands to
+	// complete, in which case the response is their JSON result as in
+	// the foreground. Otherwise, the response switches to streaming
+	// their output as Server-Sent Events, starting with the output
+	// collected during the grace period. Defaults to disabled.
+	StreamAfter string `json:"stream_after,omitempty"`
+
+	// ResponseDeadline is the maximum time HTTP requests of foreground
+	// commands wait for the result. Once elapsed, the output collected
+	// so far is responded with "partial" set, and the command goes on
+	// until it completes or its Timeout. Defaults to disabled.
+	ResponseDeadline string `json:"response_deadline,omitempty"`
+
+	// ResponseDeadlineAction is what happens to the command at the
+	// ResponseDeadline, "continue" to let it run or "kill" to kill it.
+	// Defaults to "continue".
+	ResponseDeadlineAction string `json:"response_deadline_action,omitempty"`
+
+	// Cooldown is the minimum interval between the completion of a
+	// successful execution and the next one. HTTP requests during the
+	// cooldown are rejected with CooldownStatus, with the time the next
+	// execution is allowed at. Defaults to disabled.
+	Cooldown string `json:"cooldown,omitempty"`
+
+	// HTTP status of the requests rejected during the cooldown.
+	// Defaults to 429.
+	CooldownStatus int `json:"cooldown_status,omitempty"`
+
+	// CancelOnDisconnect kills the process group of foreground commands
+	// at HTTP endpoints when the client goes away before the command
+	// completes. By default, the command keeps running for its side
+	// effects and its output is discarded. Streamed commands are always
+	// killed on disconnect.
+	CancelOnDisconnect bool `json:"cancel_on_disconnect,omitempty"`
+
+	// LineGapMetrics records the time between consecutive lines of the
+	// streamed output in the caddy_exec_line_gap_seconds histogram,
+	// labeled with the command and the stream. Defaults to false.
+	LineGapMetrics bool `json:"line_gap_metrics,omitempty"`
+
+	// Duplex streams the raw standard output of the command as the
+	// response body while the request body is written to its standard
+	// input, for interactive commands. It requires HTTP/2, or HTTP/1.1
+	// clients supporting full-duplex. The standard error is written to
+	// the logs and the exit code is sent in the X-Exec-Exit-Code trailer.
+	Duplex bool `json:"duplex,omitempty"`
+
+	// The transport of the streamed output, "sse" or "length-prefixed".
+	// With "length-prefixed", the standard output is written as binary
+	// frames of a 4-byte big-endian length followed by the raw bytes,
+	// ended by a zero-length frame and a frame of the JSON status. The
+	// standard error is written to the logs. Defaults to "sse".
+	Framing string `json:"framing,omitempty"`
+
+	// StatsInterval sends a "stats" event every interval while streaming,
+	// with the number of lines and bytes of output so far and the time
+	// elapsed, e.g. for dashboards to show the throughput. Defaults to
+	// disabled.
+	StatsInterval string `json:"stats_interval,omitempty"`
+
+	// MetadataFrame sends a "meta" event once the command started,
+	// before the streamed output, carrying the execution ID, the
+	// configured command and args, the start time and the method, path
+	// and remote address of the request as JSON. The command and args
+	// are sent without their placeholders replaced and the path without
+	// the query, so as not to echo values of the request.
+	MetadataFrame bool `json:"metadata_frame,omitempty"`
+
+	// LineTemplate is a Go text/template applied to each line of output
+	// when streaming, the result is sent as the event data. The line is
+	// available as {{.Line}} and its stream, "stdout" or "stderr", as
+	// {{.Stream}}. The raw line is sent if the template fails.
+	LineTemplate string `json:"line_template,omitempty"`
+
+	// Maps exit codes to the name of the final event sent when
+	// streaming, e.g. 0 to "done". The event data is the exit code.
+	// Unmapped exit codes end the stream with the default "error"
+	// and "close" events.
+	ExitCodeEvents map[int]string `json:"exit_code_events,omitempty"`
+
+	// ExitCodeOnly responds to HTTP requests of foreground commands
+	// with a status mapped from the exit code of the command and an
+	// empty body, instead of the JSON result.
+	ExitCodeOnly bool `json:"exit_code_only,omitempty"`
+
+	// HTTP statuses by exit code with ExitCodeOnly. Unmapped exit codes
+	// are responded with SuccessStatus if successful, 500 otherwise.
+	ExitCodeStatuses map[int]int `json:"exit_code_statuses,omitempty"`
+
+	// StderrFails makes foreground commands that write anything to the
+	// standard error fail, even if they exit with code 0, e.g. linters
+	// that report issues on stderr only. The response is an error with
+	// status 500 including the standard error; ExitCodeStatuses do not
+	// apply to it as the exit code is still 0.
+	StderrFails bool `json:"stderr_fails,omitempty"`
+
+	// ExitSemantics selects the exit codes of foreground commands which
+	// count as a success, besides 0: "default" for none, "grep" and
+	// "diff" for 1, meaning no match and differences found, or "custom"
+	// for SuccessExitCodes. The exit code is still reported as is.
+	ExitSemantics string `json:"exit_semantics,omitempty"`
+
+	// SuccessExitCodes are the exit codes which count as a success with
+	// the "custom" ExitSemantics.
+	SuccessExitCodes []int `json:"success_exit_codes,omitempty"`
+
+	// OutputLines adds the standard output and the standard error split
+	// into lines, without their line endings, to the JSON response of
+	// foreground commands at HTTP endpoints, as "stdout_lines" and
+	// "stderr_lines". The "stdout" and "stderr" strings are kept.
+	OutputLines bool `json:"output_lines,omitempty"`
+
+	// The maximum size in bytes of the standard output and of the
+	// standard error collected for the response of a foreground
+	// command. Once exceeded, the output is no longer read and the pipe
+	// is closed, the command failing to write to it, e.g. on SIGPIPE,
+	// is reported as a truncated output rather than an error.
+	// Defaults to no limit.
+	MaxOutput int64 `json:"max_output,omitempty"`
+
+	// The HTTP status of the JSON response when the command succeeds,
+	// e.g. 201 or 202. Must be a 2xx status. Defaults to 200.
+	SuccessStatus int `json:"success_status,omitempty"`
+
 	// Enables pass-thru mode, which continues to the next HTTP
 	// handler in the route instead of responding directly
 	PassThru bool `json:"pass_thru,omitempty"`
@@ -43,19 +224,207 @@ type Cmd struct {
 	// Defaults to 10s.
 	Timeout string `json:"timeout,omitempty"`
 
+	// RequestToStdin writes a JSON representation of the HTTP request,
+	// including its body, to the standard input of the command instead
+	// of the request body.
+	RequestToStdin bool `json:"request_to_stdin,omitempty"`
+
+	// Path of a file written to the standard input of the command instead
+	// of the request body. Placeholders are replaced. Relative paths are
+	// relative to StdinFileRoot.
+	StdinFile string `json:"stdin_file,omitempty"`
+
+	// The directory StdinFile must be within, symbolic links included.
+	// Requests for files outside of it are rejected. Defaults to
+	// Directory, or the working directory of Caddy.
+	StdinFileRoot string `json:"stdin_file_root,omitempty"`
+
+	// BodyToTempFile writes the request body to a temporary file, whose
+	// path is set to the {http.exec.bodyfile} placeholder, for commands
+	// that only accept a file path. The file is removed once the command
+	// completed. Commands cannot run in the background.
+	BodyToTempFile bool `json:"body_to_temp_file,omitempty"`
+
+	// The directory of the temporary files of BodyToTempFile.
+	// Defaults to the default directory for temporary files of the OS.
+	TempDir string `json:"temp_dir,omitempty"`
+
+	// The maximum size in bytes of the body with RequestToStdin or
+	// BodyToTempFile. Larger requests are rejected. Defaults to 1MiB.
+	RequestBodyLimit int64 `json:"request_body_limit,omitempty"`
+
+	// Headers excluded from the request with RequestToStdin.
+	// Defaults to Authorization, Proxy-Authorization and Cookie.
+	RequestExcludeHeaders []string `json:"request_exclude_headers,omitempty"`
+
+	// Probe makes the handler a health check of the command. Requests
+	// are responded with 200 if the command succeeds and its output
+	// matches ProbeExpect, 503 otherwise. The body only contains the
+	// status text.
+	Probe bool `json:"probe,omitempty"`
+
+	// Regular expression the standard output of the probe must match.
+	// Defaults to only checking the exit code.
+	ProbeExpect string `json:"probe_expect,omitempty"`
+
+	// Duration the result of the probe is reused by subsequent health
+	// checks. Defaults to 5s.
+	ProbeCache string `json:"probe_cache,omitempty"`
+
+	// Duration after which the probe is killed and fails, instead of
+	// Timeout, as health checks wait for it. Defaults to 2s.
+	ProbeTimeout string `json:"probe_timeout,omitempty"`
+
+	// Debounce postpones the execution of HTTP triggered commands
+	// until no new request has arrived for the given duration.
+	// Requests of a burst are collapsed into a single execution
+	// and all receive its result.
+	Debounce string `json:"debounce,omitempty"`
+
+	// The maximum duration a debounced execution can be postponed
+	// by a continuous burst of requests. Defaults to no limit.
+	DebounceMaxWait string `json:"debounce_max_wait,omitempty"`
+
+	// Heartbeat is the interval at which heartbeats are written to the
+	// client while a foreground command is running. The response status
+	// is committed as 200 once the first heartbeat is sent, the outcome of
+	// the command is only reported by the final result object.
+	// Defaults to no heartbeat.
+	Heartbeat string `json:"heartbeat,omitempty"`
+
+	// The format of the heartbeats. "json" writes a
+	// {"heartbeat": true, "elapsed_ms": ...} object per line before the
+	// final result object, "whitespace" writes a newline which keeps the
+	// response body a single JSON document. Defaults to "json".
+	HeartbeatFormat string `json:"heartbeat_format,omitempty"`
+
+	// Signals received by Caddy to forward to the running processes
+	// of the command, e.g. SIGUSR1 to make them reopen their logs.
+	// Only SIGHUP, SIGUSR1, SIGUSR2 and SIGWINCH can be forwarded,
+	// Caddy keeps handling them as usual. Not supported on Windows.
+	ForwardSignals []string `json:"forward_signals,omitempty"`
+
+	// Name of the environment variable set to the execution ID, so that
+	// the command can forward it as a correlation ID in its own HTTP
+	// requests. It is the request's {http.request.uuid} for HTTP
+	// triggered commands. Defaults to "EXEC_CORRELATION_ID".
+	CorrelationIDEnv string `json:"correlation_id_env,omitempty"`
+
+	// Name of the environment variable set to the traceparent header of
+	// the request, if any. Defaults to "TRACEPARENT".
+	TraceparentEnv string `json:"traceparent_env,omitempty"`
+
+	// ClaimsToEnv maps claims of the authenticated user to environment
+	// variables of the command, e.g. "tenant" to "TENANT". Claims are
+	// read from the {http.auth.user.*} placeholders set by the upstream
+	// authentication handler, such as a JWT provider, "id" being the ID
+	// of the user. Only the mapped claims are set, missing claims are
+	// left unset.
+	ClaimsToEnv map[string]string `json:"claims_to_env,omitempty"`
+
+	// Names of environment variables inherited from Caddy to remove from
+	// the environment of the command, e.g. HTTP_PROXY. They are removed
+	// last, variables set by the module are removed too.
+	UnsetEnv []string `json:"unset_env,omitempty"`
+
+	// The number of times to retry starting the command when it fails
+	// with one of StartRetryErrors, e.g. when the process limit is
+	// reached. Retries are delayed by 10ms, doubled for each retry.
+	// Defaults to 0.
+	StartRetries int `json:"start_retries,omitempty"`
+
+	// The errors of a failed start to retry, among EAGAIN, EINTR,
+	// EMFILE, ENFILE, ENOMEM and ETXTBSY. Defaults to EAGAIN.
+	StartRetryErrors []string `json:"start_retry_errors,omitempty"`
+
+	// The maximum number of concurrent runs of the command with the same
+	// args, after replacing placeholders. Runs with different args are
+	// not limited. Defaults to no limit.
+	MaxIdentical int `json:"max_identical,omitempty"`
+
+	// What to do with runs exceeding MaxIdentical, "wait" for a running
+	// one to complete or "reject" them. Rejected HTTP requests are
+	// responded with 503. Defaults to "wait".
+	IdenticalOverflow string `json:"identical_overflow,omitempty"`
+
+	// LockKey serializes the runs of the commands resolving it to the
+	// same key, e.g. "deploy-{http.request.uri.path.1}" for one deploy
+	// per project at a time. Placeholders are replaced per request, runs
+	// with different keys are not serialized. The lock is shared by all
+	// the commands with the same key, and held until the process exits.
+	LockKey string `json:"lock_key,omitempty"`
+
+	// How long to wait for the lock of LockKey held by another run.
+	// Runs still waiting are rejected, HTTP requests are responded with
+	// 409. Defaults to waiting until the lock is released.
+	LockTimeout string `json:"lock_timeout,omitempty"`
+
+	// Name of a pool declared in the exec app. The processes of all
+	// the commands referencing the pool count towards its limit, a
+	// command waits for a free slot before it starts.
+	Pool string `json:"pool,omitempty"`
+
+	// The character encoding of the command output, e.g. "latin1" or
+	// "shift_jis". The output is converted to UTF-8 before it is sent
+	// to the client. Defaults to UTF-8.
+	InputEncoding string `json:"input_encoding,omitempty"`
+
+	// Address of a syslog server to mirror each line of output to as
+	// RFC 5424 messages, e.g. "udp://localhost:514" or
+	// "tcp://localhost:601". The network defaults to udp. Failures to
+	// reach the server do not affect the command.
+	SyslogAddr string `json:"syslog_addr,omitempty"`
+
+	// The APP-NAME of the syslog messages. Defaults to "caddy-exec".
+	SyslogTag string `json:"syslog_tag,omitempty"`
+
 	// When the command should run. This can contain either of
 	// "startup" or "shutdown".
 	At []string `json:"at,omitempty"`
 
+	// KeepHistory keeps the last N completed executions of the command,
+	// with their status, exit code, duration and up to 4KiB of their
+	// output if it is collected. They are served by the admin endpoint
+	// at /exec/history. Defaults to 0, no history.
+	KeepHistory int `json:"keep_history,omitempty"`
+
+	// AllowAttach lets admin clients attach to the output of running
+	// executions of the command at /exec/executions/<id>, receiving the
+	// last lines and then new lines as they are produced.
+	AllowAttach bool `json:"allow_attach,omitempty"`
+
+	// LogSample logs the exit of 1 in N successful executions, chosen
+	// at random, to keep high-volume commands from flooding the logs.
+	// Failed executions are always logged, as are all executions when
+	// the debug level is enabled. Defaults to logging every execution.
+	LogSample int `json:"log_sample,omitempty"`
+
 	// Standard output log.
 	StdWriterRaw json.RawMessage `json:"log,omitempty" caddy:"namespace=caddy.logging.writers inline_key=output"`
 
 	// Standard error log.
 	ErrWriterRaw json.RawMessage `json:"err_log,omitempty" caddy:"namespace=caddy.logging.writers inline_key=output"`
 
-	timeout time.Duration       // ease of use after parsing timeout string
-	at      map[string]struct{} // for quicker access and uniqueness.
-	log     *zap.Logger
+	timeout          time.Duration       // ease of use after parsing timeout string
+	at               map[string]struct{} // for quicker access and uniqueness.
+	log              *zap.Logger
+	debouncer        *debouncer
+	heartbeat        time.Duration
+	streamAfter      time.Duration
+	responseDeadline time.Duration
+	lockTimeout      time.Duration
+	loginShell       string // path of the shell with LoginShell
+	statsInterval    time.Duration
+	cooldown         *cooldown // nil if disabled
+	history          *history  // nil if disabled
+	running          *processes
+	decoder          encoding.Encoding // nil if the output is UTF-8
+	lineTmpl         *template.Template
+	syslog           *syslogConn
+	prober           *prober
+	pool             *pool // nil if not in a pool
+	identical        *keyedLimiter
+	lineGap          *prometheus.HistogramVec
 
 	// logging
 	stdWriter io.WriteCloser
@@ -76,6 +445,192 @@ func (c *Cmd) provision(ctx caddy.Context, cm caddy.Module) error {
 	}
 	c.timeout = dur
 
+	// debounce
+	if c.Debounce != "" {
+		wait, err := time.ParseDuration(c.Debounce)
+		if err != nil {
+			return err
+		}
+		var maxWait time.Duration
+		if c.DebounceMaxWait != "" {
+			maxWait, err = time.ParseDuration(c.DebounceMaxWait)
+			if err != nil {
+				return err
+			}
+		}
+		c.debouncer = newDebouncer(wait, maxWait)
+	}
+
+	// heartbeat
+	if c.Heartbeat != "" {
+		c.heartbeat, err = time.ParseDuration(c.Heartbeat)
+		if err != nil {
+			return err
+		}
+	}
+
+	// history
+	if c.KeepHistory > 0 {
+		c.history = newHistory(c)
+		addHistory(c.history)
+	}
+
+	// cooldown
+	if c.Cooldown != "" {
+		period, err := time.ParseDuration(c.Cooldown)
+		if err != nil {
+			return err
+		}
+		c.cooldown = newCooldown(period)
+	}
+
+	// stream after
+	if c.StreamAfter != "" {
+		c.streamAfter, err = time.ParseDuration(c.StreamAfter)
+		if err != nil {
+			return err
+		}
+	}
+
+	// stats interval
+	if c.StatsInterval != "" {
+		c.statsInterval, err = time.ParseDuration(c.StatsInterval)
+		if err != nil {
+			return err
+		}
+	}
+
+	// response deadline
+	if c.ResponseDeadline != "" {
+		c.responseDeadline, err = time.ParseDuration(c.ResponseDeadline)
+		if err != nil {
+			return err
+		}
+	}
+
+	// lock
+	if c.LockTimeout != "" {
+		c.lockTimeout, err = time.ParseDuration(c.LockTimeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	// login shell
+	if c.LoginShell {
+		c.loginShell, err = lookLoginShell(c.LoginShellPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	// read-only root
+	if c.ReadOnlyRoot && !sandboxSupported {
+		c.log.Warn("read_only_root is not supported on this platform, the command runs unrestricted",
+			zap.String("command", c.Command))
+	}
+
+	// buffered commands which do not exit by themselves
+	if c.Foreground && !c.Stream && neverExits(c.Command, c.Args) {
+		c.log.Warn("the command does not exit by itself, requests wait for the timeout and get the partial output, consider stream",
+			zap.String("command", c.Command),
+			zap.Duration("timeout", c.timeout))
+	}
+
+	// running processes
+	c.running = newProcesses()
+	if len(c.ForwardSignals) > 0 {
+		sigs := make([]os.Signal, len(c.ForwardSignals))
+		for i, name := range c.ForwardSignals {
+			sigs[i], err = parseSignal(name)
+			if err != nil {
+				return err
+			}
+		}
+		forwarder.add(c.running, sigs)
+	}
+
+	// input encoding
+	if c.InputEncoding != "" {
+		enc, err := htmlindex.Get(c.InputEncoding)
+		if err != nil {
+			return fmt.Errorf("unknown input encoding '%s': %v", c.InputEncoding, err)
+		}
+		if enc != unicode.UTF8 {
+			c.decoder = enc
+		}
+	}
+
+	// line template
+	if c.LineTemplate != "" {
+		c.lineTmpl, err = template.New("line").Parse(c.LineTemplate)
+		if err != nil {
+			return fmt.Errorf("parsing line template: %v", err)
+		}
+	}
+
+	// syslog
+	if c.SyslogAddr != "" {
+		c.syslog, err = getSyslogConn(c.SyslogAddr)
+		if err != nil {
+			return err
+		}
+	}
+
+	// probe
+	if c.Probe {
+		c.prober = &prober{cache: defaultProbeCache, timeout: defaultProbeTimeout}
+		if c.ProbeExpect != "" {
+			c.prober.expect, err = regexp.Compile(c.ProbeExpect)
+			if err != nil {
+				return fmt.Errorf("parsing probe_expect: %v", err)
+			}
+		}
+		if c.ProbeCache != "" {
+			c.prober.cache, err = time.ParseDuration(c.ProbeCache)
+			if err != nil {
+				return err
+			}
+		}
+		if c.ProbeTimeout != "" {
+			c.prober.timeout, err = time.ParseDuration(c.ProbeTimeout)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// metrics
+	if c.LineGapMetrics {
+		c.lineGap, err = registerLineGap(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// identical runs
+	if c.MaxIdentical > 0 {
+		c.identical = newKeyedLimiter(c.MaxIdentical)
+	}
+
+	// pool
+	if c.Pool != "" {
+		c.pool, err = lookupPool(ctx, cm, c.Pool)
+		if err != nil {
+			return err
+		}
+	}
+
+	// steps
+	for i := range c.Steps {
+		if c.RequireAbsolutePath {
+			c.Steps[i].RequireAbsolutePath = true
+		}
+		if err := c.Steps[i].provision(ctx, cm); err != nil {
+			return err
+		}
+	}
+
 	// at
 	if c.at == nil {
 		c.at = map[string]struct{}{}
@@ -100,6 +655,65 @@ func (c *Cmd) provision(ctx caddy.Context, cm caddy.Module) error {
 	return nil
 }
 
+// decodeReader returns a reader converting the output read from r to UTF-8.
+func (c *Cmd) decodeReader(r io.Reader) io.Reader {
+	if c.decoder == nil {
+		return r
+	}
+	return transform.NewReader(r, c.decoder.NewDecoder())
+}
+
+// decodeBytes converts the output b to UTF-8.
+func (c *Cmd) decodeBytes(b []byte) []byte {
+	if c.decoder == nil {
+		return b
+	}
+	decoded, err := c.decoder.NewDecoder().Bytes(b)
+	if err != nil {
+		c.log.Error("decoding output", zap.String("encoding", c.InputEncoding), zap.Error(err))
+		return b
+	}
+	return decoded
+}
+
+// formatLine applies the line template to a line of output of stream.
+func (c *Cmd) formatLine(stream, line string) string {
+	if c.lineTmpl == nil {
+		return line
+	}
+
+	var buf strings.Builder
+	data := struct{ Line, Stream string }{line, stream}
+	if err := c.lineTmpl.Execute(&buf, data); err != nil {
+		c.log.Debug("executing line template", zap.Error(err))
+		return line
+	}
+	return buf.String()
+}
+
+// kill kills the running processes of the command and its steps.
+func (c *Cmd) kill() {
+	for i := range c.Steps {
+		c.Steps[i].kill()
+	}
+	if c.running != nil {
+		c.running.kill()
+	}
+}
+
+// cleanup releases the resources acquired during provisioning.
+func (c *Cmd) cleanup() {
+	for i := range c.Steps {
+		c.Steps[i].cleanup()
+	}
+	if c.running != nil {
+		forwarder.remove(c.running)
+	}
+	if c.history != nil {
+		removeHistory(c.history)
+	}
+}
+
 func writerFromRaw(ctx caddy.Context, c *Cmd, field string, w json.RawMessage) (io.WriteCloser, error) {
 	var err error
 	var writerOpener caddy.WriterOpener
@@ -129,14 +743,305 @@ func writerFromRaw(ctx caddy.Context, c *Cmd, field string, w json.RawMessage) (
 
 // Validate implements caddy.Validator.
 func (c Cmd) validate() error {
+	if len(c.Steps) > 0 {
+		return c.validateSteps()
+	}
+
 	if c.Command == "" {
 		return fmt.Errorf("command is required")
 	}
+	// commands with placeholders are checked once replaced.
+	dynamic := strings.Contains(c.Command, "{") || len(c.PipeTo) > 0 && strings.Contains(c.PipeTo[0], "{")
+	if !dynamic {
+		if err := c.checkCommandPath(); err != nil {
+			return err
+		}
+	}
 
 	if err := isValidDir(c.Directory); err != nil {
 		return err
 	}
 
+	if len(c.WritablePaths) > 0 && !c.ReadOnlyRoot {
+		return fmt.Errorf("writable_paths requires read_only_root")
+	}
+	for _, path := range c.WritablePaths {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("writable path '%s' is not absolute", path)
+		}
+		if err := isValidDir(path); err != nil {
+			return err
+		}
+	}
+
+	if (c.ProbeExpect != "" || c.ProbeCache != "" || c.ProbeTimeout != "") && !c.Probe {
+		return fmt.Errorf("probe_expect, probe_cache and probe_timeout require probe")
+	}
+
+	if c.Debounce != "" && c.Stream {
+		return fmt.Errorf("debounce cannot be used with stream")
+	}
+	if c.DebounceMaxWait != "" && c.Debounce == "" {
+		return fmt.Errorf("debounce_max_wait requires debounce")
+	}
+
+	if c.BodyToTempFile {
+		switch {
+		case c.RequestToStdin:
+			return fmt.Errorf("body_to_temp_file cannot be used with request_to_stdin")
+		case !c.Foreground && !c.Stream && c.StreamAfter == "" && len(c.Steps) == 0:
+			return fmt.Errorf("body_to_temp_file cannot be used with commands running in the background")
+		case c.PassThru:
+			return fmt.Errorf("body_to_temp_file cannot be used with pass_thru")
+		}
+	}
+	if c.TempDir != "" && !c.BodyToTempFile {
+		return fmt.Errorf("temp_dir requires body_to_temp_file")
+	}
+
+	if c.StdinFile != "" && c.RequestToStdin {
+		return fmt.Errorf("stdin_file cannot be used with request_to_stdin")
+	}
+	if c.StdinFileRoot != "" && c.StdinFile == "" {
+		return fmt.Errorf("stdin_file_root requires stdin_file")
+	}
+
+	if c.StreamAfter != "" {
+		switch {
+		case c.Stream:
+			return fmt.Errorf("stream_after cannot be used with stream")
+		case len(c.Steps) > 0:
+			return fmt.Errorf("stream_after cannot be used with steps")
+		case c.Debounce != "":
+			return fmt.Errorf("stream_after cannot be used with debounce")
+		case c.Heartbeat != "":
+			return fmt.Errorf("stream_after cannot be used with heartbeat")
+		case c.PassThru:
+			return fmt.Errorf("stream_after cannot be used with pass_thru")
+		case c.MaxOutput > 0:
+			return fmt.Errorf("stream_after cannot be used with max_output")
+		}
+	}
+
+	if c.LockTimeout != "" && c.LockKey == "" {
+		return fmt.Errorf("lock_timeout requires lock_key")
+	}
+
+	if len(c.PipeTo) > 0 {
+		switch {
+		case !c.Foreground || c.Stream:
+			return fmt.Errorf("pipe_to requires foreground without stream")
+		case c.PassThru:
+			return fmt.Errorf("pipe_to cannot be used with pass_thru")
+		case c.StreamAfter != "":
+			return fmt.Errorf("pipe_to cannot be used with stream_after")
+		}
+	}
+
+	if c.ResponseDeadline != "" {
+		switch {
+		case !c.Foreground || c.Stream:
+			return fmt.Errorf("response_deadline requires foreground without stream")
+		case len(c.Steps) > 0:
+			return fmt.Errorf("response_deadline cannot be used with steps")
+		case c.Debounce != "":
+			return fmt.Errorf("response_deadline cannot be used with debounce")
+		case c.Heartbeat != "":
+			return fmt.Errorf("response_deadline cannot be used with heartbeat")
+		case c.PassThru:
+			return fmt.Errorf("response_deadline cannot be used with pass_thru")
+		case c.StreamAfter != "":
+			return fmt.Errorf("response_deadline cannot be used with stream_after")
+		case c.ExitCodeOnly:
+			return fmt.Errorf("response_deadline cannot be used with exit_code_only")
+		case c.BodyToTempFile && c.ResponseDeadlineAction != "kill":
+			// the file is removed once the response is written
+			return fmt.Errorf("response_deadline cannot be used with body_to_temp_file, unless the command is killed")
+		}
+	}
+	switch c.ResponseDeadlineAction {
+	case "", "continue", "kill":
+	default:
+		return fmt.Errorf("invalid response_deadline_action '%s', must be continue or kill", c.ResponseDeadlineAction)
+	}
+	if c.ResponseDeadlineAction != "" && c.ResponseDeadline == "" {
+		return fmt.Errorf("response_deadline_action requires response_deadline")
+	}
+
+	if c.CancelOnDisconnect && c.Debounce != "" {
+		return fmt.Errorf("cancel_on_disconnect cannot be used with debounce")
+	}
+
+	if c.ExitCodeOnly {
+		switch {
+		case !c.Foreground:
+			return fmt.Errorf("exit_code_only requires foreground")
+		case len(c.Steps) > 0:
+			return fmt.Errorf("exit_code_only cannot be used with steps")
+		case c.Heartbeat != "":
+			return fmt.Errorf("exit_code_only cannot be used with heartbeat")
+		case c.PassThru:
+			return fmt.Errorf("exit_code_only cannot be used with pass_thru")
+		case c.StreamAfter != "":
+			return fmt.Errorf("exit_code_only cannot be used with stream_after")
+		}
+	}
+	switch c.ExitSemantics {
+	case "", "default", "grep", "diff":
+		if len(c.SuccessExitCodes) > 0 {
+			return fmt.Errorf("success_exit_codes requires the custom exit_semantics")
+		}
+	case "custom":
+		if len(c.SuccessExitCodes) == 0 {
+			return fmt.Errorf("the custom exit_semantics requires success_exit_codes")
+		}
+	default:
+		return fmt.Errorf("invalid exit_semantics '%s', must be default, grep, diff or custom", c.ExitSemantics)
+	}
+
+	if c.StderrFails {
+		switch {
+		case !c.Foreground:
+			return fmt.Errorf("stderr_fails requires foreground")
+		case len(c.Steps) > 0:
+			return fmt.Errorf("stderr_fails cannot be used with steps")
+		case c.PassThru:
+			return fmt.Errorf("stderr_fails cannot be used with pass_thru")
+		case c.StreamAfter != "":
+			return fmt.Errorf("stderr_fails cannot be used with stream_after")
+		}
+	}
+	if len(c.ExitCodeStatuses) > 0 && !c.ExitCodeOnly {
+		return fmt.Errorf("exit_code_statuses requires exit_code_only")
+	}
+	for code, status := range c.ExitCodeStatuses {
+		if status < 200 || status > 599 {
+			return fmt.Errorf("invalid status %d for exit code %d", status, code)
+		}
+	}
+
+	if c.CooldownStatus != 0 && (c.CooldownStatus < 400 || c.CooldownStatus > 599) {
+		return fmt.Errorf("cooldown_status must be a 4xx or 5xx status")
+	}
+
+	if c.SuccessStatus != 0 && (c.SuccessStatus < 200 || c.SuccessStatus > 299) {
+		return fmt.Errorf("success_status must be a 2xx status")
+	}
+
+	if c.MaxOutput < 0 {
+		return fmt.Errorf("max_output cannot be negative")
+	}
+
+	if c.correlationIDEnv() == c.traceparentEnv() {
+		return fmt.Errorf("correlation_id_env and traceparent_env cannot both be '%s'", c.correlationIDEnv())
+	}
+	claimNames := map[string]string{}
+	for claim, name := range c.ClaimsToEnv {
+		if claim == "" || name == "" || strings.ContainsAny(name, "=\x00") {
+			return fmt.Errorf("invalid environment variable '%s' for claim '%s'", name, claim)
+		}
+		// the variable would be set to either claim at random
+		if other, ok := claimNames[name]; ok {
+			return fmt.Errorf("claims '%s' and '%s' are both mapped to environment variable '%s'", min(claim, other), max(claim, other), name)
+		}
+		claimNames[name] = claim
+		if name == c.correlationIDEnv() || name == c.traceparentEnv() {
+			return fmt.Errorf("claim '%s' is mapped to environment variable '%s', already set to the correlation ID or traceparent", claim, name)
+		}
+	}
+
+	if c.LoginShellPath != "" && !c.LoginShell {
+		return fmt.Errorf("login_shell_path requires login_shell")
+	}
+
+	if c.KeepHistory < 0 {
+		return fmt.Errorf("keep_history cannot be negative")
+	}
+
+	if c.LogSample < 0 {
+		return fmt.Errorf("log_sample cannot be negative")
+	}
+
+	if c.MaxIdentical < 0 {
+		return fmt.Errorf("max_identical cannot be negative")
+	}
+	switch c.IdenticalOverflow {
+	case "", "wait", "reject":
+	default:
+		return fmt.Errorf("'identical_overflow' can only be one of 'wait' or 'reject'")
+	}
+
+	if c.StartRetries < 0 {
+		return fmt.Errorf("start_retries cannot be negative")
+	}
+	for _, name := range c.StartRetryErrors {
+		if _, ok := startRetryErrnos[name]; !ok {
+			return fmt.Errorf("start_retry_errors: unsupported error '%s'", name)
+		}
+	}
+
+	if c.RequestBodyLimit < 0 {
+		return fmt.Errorf("request_body_limit cannot be negative")
+	}
+
+	for code, event := range c.ExitCodeEvents {
+		if event == "" || strings.ContainsAny(event, "\r\n") {
+			return fmt.Errorf("invalid event name for exit code %d", code)
+		}
+	}
+
+	if c.Duplex {
+		switch {
+		case !c.Stream:
+			return fmt.Errorf("duplex requires stream")
+		case len(c.Steps) > 0:
+			return fmt.Errorf("duplex cannot be used with steps")
+		case c.Framing != "" && c.Framing != "sse":
+			return fmt.Errorf("duplex cannot be used with framing")
+		case c.RequestToStdin || c.StdinFile != "" || c.BodyToTempFile:
+			return fmt.Errorf("duplex requires the request body as standard input")
+		}
+	}
+
+	if c.StatsInterval != "" {
+		switch {
+		case !c.Stream:
+			return fmt.Errorf("stats_interval requires stream")
+		case c.Duplex || c.Framing == framingLengthPrefixed:
+			return fmt.Errorf("stats_interval requires the sse framing")
+		}
+	}
+
+	if c.MetadataFrame {
+		switch {
+		case !c.Stream:
+			return fmt.Errorf("metadata_frame requires stream")
+		case len(c.Steps) > 0:
+			return fmt.Errorf("metadata_frame cannot be used with steps")
+		case c.Duplex || c.Framing == framingLengthPrefixed:
+			return fmt.Errorf("metadata_frame requires the sse framing")
+		}
+	}
+
+	switch c.Framing {
+	case "", "sse":
+	case framingLengthPrefixed:
+		if !c.Stream {
+			return fmt.Errorf("'framing' requires stream")
+		}
+		if len(c.Steps) > 0 {
+			return fmt.Errorf("'framing' '%s' cannot be used with steps", c.Framing)
+		}
+	default:
+		return fmt.Errorf("'framing' can only be one of 'sse' or 'length-prefixed'")
+	}
+
+	switch c.HeartbeatFormat {
+	case "", "json", "whitespace":
+	default:
+		return fmt.Errorf("'heartbeat_format' can only be one of 'json' or 'whitespace'")
+	}
+
 	for _, at := range c.At {
 		switch at {
 		case "startup":
@@ -149,6 +1054,134 @@ func (c Cmd) validate() error {
 	return nil
 }
 
+func (c Cmd) validateSteps() error {
+	if c.Command != "" {
+		return fmt.Errorf("command cannot be used with steps")
+	}
+	if c.Debounce != "" {
+		return fmt.Errorf("debounce cannot be used with steps")
+	}
+	if len(c.PipeTo) > 0 {
+		return fmt.Errorf("pipe_to cannot be used with steps")
+	}
+	if c.LockKey != "" {
+		return fmt.Errorf("lock_key cannot be used with steps, set it on the steps")
+	}
+
+	for i, step := range c.Steps {
+		if len(step.Steps) > 0 {
+			return fmt.Errorf("step %d: steps cannot be nested", i)
+		}
+		if len(step.PipeTo) > 0 {
+			return fmt.Errorf("step %d: pipe_to cannot be used with steps", i)
+		}
+		if err := step.validate(); err != nil {
+			return fmt.Errorf("step %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// exitCodeStatus returns the status of the response with ExitCodeOnly
+// for a command that exited with code and completed with err.
+func (c *Cmd) exitCodeStatus(code int, err error) int {
+	if err == errStderrOutput {
+		return http.StatusInternalServerError
+	}
+	if status, ok := c.ExitCodeStatuses[code]; ok {
+		return status
+	}
+	if err == nil {
+		return c.successStatus()
+	}
+	return http.StatusInternalServerError
+}
+
+// successStatus returns the HTTP status of a successful JSON response.
+func (c *Cmd) successStatus() int {
+	if c.SuccessStatus == 0 {
+		return http.StatusOK
+	}
+	return c.SuccessStatus
+}
+
+// successExitCode reports whether a command exiting with code succeeded
+// according to ExitSemantics.
+func (c *Cmd) successExitCode(code int) bool {
+	switch c.ExitSemantics {
+	case "grep", "diff":
+		return code == 0 || code == 1
+	case "custom":
+		return code == 0 || slices.Contains(c.SuccessExitCodes, code)
+	}
+	return code == 0
+}
+
+// replaceCommand returns the command with placeholders replaced by repl.
+func (c *Cmd) replaceCommand(repl *caddy.Replacer) string {
+	return repl.ReplaceAll(c.Command, "")
+}
+
+// checkCommandPath returns an error if the command must be an absolute
+// path and is not.
+func (c *Cmd) checkCommandPath() error {
+	if !c.RequireAbsolutePath {
+		return nil
+	}
+	if !filepath.IsAbs(c.Command) {
+		return fmt.Errorf("command '%s' is not an absolute path, required by require_absolute_path", c.Command)
+	}
+	if len(c.PipeTo) > 0 && !filepath.IsAbs(c.PipeTo[0]) {
+		return fmt.Errorf("pipe_to command '%s' is not an absolute path, required by require_absolute_path", c.PipeTo[0])
+	}
+	return nil
+}
+
+// replaceArgs returns the args with placeholders replaced by repl.
+func (c *Cmd) replaceArgs(repl *caddy.Replacer) []string {
+	argv := make([]string, len(c.Args))
+	for index, argument := range c.Args {
+		argv[index] = repl.ReplaceAll(argument, "")
+	}
+	return argv
+}
+
+// loginShells are the shells supported by LoginShell, which accept the
+// -l and -c flags of POSIX shells.
+var loginShells = []string{"sh", "ash", "dash", "bash", "ksh", "zsh"}
+
+// lookLoginShell returns the path of the login shell, "bash" if empty.
+func lookLoginShell(shell string) (string, error) {
+	if shell == "" {
+		shell = "bash"
+	}
+	if !slices.Contains(loginShells, filepath.Base(shell)) {
+		return "", fmt.Errorf("login shell '%s' is not supported, must be one of %s", shell, strings.Join(loginShells, ", "))
+	}
+	path, err := exec.LookPath(shell)
+	if err != nil {
+		return "", fmt.Errorf("login shell: %v", err)
+	}
+	return path, nil
+}
+
+// neverExits reports whether the command is known to keep running
+// until it is killed, e.g. tail -f.
+func neverExits(command string, args []string) bool {
+	switch filepath.Base(command) {
+	case "yes", "watch":
+		return true
+	case "tail":
+		for _, arg := range args {
+			if arg == "-f" || arg == "-F" || arg == "--follow" || strings.HasPrefix(arg, "--follow=") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func isValidDir(dir string) error {
 	// current directory is valid
 	if dir == "" {
@@ -0,0 +1,59 @@
+package command
+
+import "testing"
+
+func TestValidateClaimsToEnv(t *testing.T) {
+	for name, test := range map[string]struct {
+		claims map[string]string
+		valid  bool
+	}{
+		"distinct":    {map[string]string{"id": "USER_ID", "role": "USER_ROLE"}, true},
+		"duplicate":   {map[string]string{"id": "USER", "name": "USER"}, false},
+		"invalid":     {map[string]string{"id": "USER=ID"}, false},
+		"correlation": {map[string]string{"id": "EXEC_CORRELATION_ID"}, false},
+		"traceparent": {map[string]string{"trace": "TRACEPARENT"}, false},
+	} {
+		c := Cmd{Command: "echo", ClaimsToEnv: test.claims}
+		if err := c.validate(); (err == nil) != test.valid {
+			t.Errorf("%s: unexpected validation result %v", name, err)
+		}
+	}
+}
+
+func TestValidateCorrelationEnv(t *testing.T) {
+	c := Cmd{Command: "echo", CorrelationIDEnv: "TRACE", TraceparentEnv: "TRACE"}
+	if err := c.validate(); err == nil {
+		t.Error("the correlation ID and traceparent are mapped to the same environment variable")
+	}
+
+	c = Cmd{Command: "echo", CorrelationIDEnv: "REQUEST_ID", ClaimsToEnv: map[string]string{"id": "REQUEST_ID"}}
+	if err := c.validate(); err == nil {
+		t.Error("a claim is mapped to the environment variable of the correlation ID")
+	}
+}
+
+func TestValidateResponseDeadlineBodyFile(t *testing.T) {
+	c := Cmd{Command: "cat", Foreground: true, BodyToTempFile: true, ResponseDeadline: "1s"}
+	if err := c.validate(); err == nil {
+		t.Error("the body file of commands left running at the response deadline is accepted")
+	}
+
+	c.ResponseDeadlineAction = "kill"
+	if err := c.validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateExitCodeOnlyStreamAfter(t *testing.T) {
+	c := Cmd{Command: "true", Foreground: true, ExitCodeOnly: true, StreamAfter: "5s"}
+	if err := c.validate(); err == nil {
+		t.Error("exit_code_only is accepted with stream_after, which ignores it")
+	}
+}
+
+func TestValidateStderrFailsStreamAfter(t *testing.T) {
+	c := Cmd{Command: "true", Foreground: true, StderrFails: true, StreamAfter: "5s"}
+	if err := c.validate(); err == nil {
+		t.Error("stderr_fails is accepted with stream_after, which ignores it")
+	}
+}
@@ -0,0 +1,71 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// cooldown enforces a minimum interval between the completion of a
+// successful execution and the next execution.
+type cooldown struct {
+	period time.Duration
+
+	mu   sync.Mutex
+	next time.Time // zero until the first successful execution
+}
+
+func newCooldown(period time.Duration) *cooldown {
+	return &cooldown{period: period}
+}
+
+// record starts the cooldown after a successful execution.
+func (c *cooldown) record() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.next = time.Now().Add(c.period)
+}
+
+// allowed reports whether an execution is allowed now, and otherwise
+// when the next one is.
+func (c *cooldown) allowed() (next time.Time, ok bool) {
+	if c == nil {
+		return time.Time{}, true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.next, !time.Now().Before(c.next)
+}
+
+// serveCooldown responds to a request rejected during the cooldown,
+// with the time the next execution is allowed at.
+func (m Middleware) serveCooldown(w http.ResponseWriter, next time.Time) error {
+	status := m.CooldownStatus
+	if status == 0 {
+		status = http.StatusTooManyRequests
+	}
+	retryAfter := int(math.Ceil(time.Until(next).Seconds()))
+
+	resp := struct {
+		Status  string `json:"status"`
+		Error   string `json:"error"`
+		NextRun string `json:"next_run"`
+	}{
+		Status:  "error",
+		Error:   fmt.Sprintf("cooling down, next run allowed in %ds", retryAfter),
+		NextRun: next.UTC().Format(time.RFC3339),
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("X-Exec-Next-Run", resp.NextRun)
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,71 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// errResponseDeadline fails commands killed at ResponseDeadline.
+var errResponseDeadline = errors.New("response deadline exceeded, the command was killed")
+
+// collectOutputUntilDeadline runs the command for r and collects its
+// output. If it does not complete within ResponseDeadline, the output
+// collected so far is returned as partial, and the command is killed
+// or left running according to ResponseDeadlineAction.
+func (m Middleware) collectOutputUntilDeadline(r *http.Request, argv []string, stdin io.Reader) output {
+	// the command may outlive the request, a disconnect only cancels
+	// it until the deadline with CancelOnDisconnect.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	stopCancel := func() bool { return false }
+	if m.CancelOnDisconnect {
+		stopCancel = context.AfterFunc(r.Context(), cancel)
+	}
+
+	stdoutBuf := &limitedBuffer{limit: m.MaxOutput}
+	stderrBuf := &limitedBuffer{limit: m.MaxOutput}
+	done := make(chan output, 1)
+	go func() {
+		defer cancel()
+		done <- m.collectOutputTo(ctx, argv, stdin, stdoutBuf, stderrBuf)
+	}()
+
+	timer := time.NewTimer(m.responseDeadline)
+	defer timer.Stop()
+	select {
+	case out := <-done:
+		stopCancel()
+		return out
+	case <-timer.C:
+	}
+
+	stopCancel()
+	stdout, stdoutTruncated := stdoutBuf.snapshot()
+	stderr, stderrTruncated := stderrBuf.snapshot()
+	out := output{
+		stdout:      m.decodeBytes(stdout),
+		stderr:      m.decodeBytes(stderr),
+		exitCode:    -1,
+		stdoutBytes: int64(len(stdout)),
+		stderrBytes: int64(len(stderr)),
+		truncated:   stdoutTruncated || stderrTruncated,
+		partial:     true,
+	}
+
+	if m.ResponseDeadlineAction == "kill" {
+		cancel()
+		out.err = errResponseDeadline
+		return out
+	}
+
+	go func() {
+		if out := <-done; out.err != nil {
+			m.log.Error("command finished with error after the response deadline", zap.Error(out.err))
+		}
+	}()
+	return out
+}
@@ -0,0 +1,75 @@
+package command
+
+import (
+	"sync"
+	"time"
+)
+
+// debouncer collapses bursts of calls into a single execution that runs
+// once no new call has arrived for the quiet interval.
+type debouncer struct {
+	wait    time.Duration
+	maxWait time.Duration
+
+	mu      sync.Mutex
+	pending *debounceCall
+}
+
+// debounceCall is a pending execution shared by all callers of a burst.
+type debounceCall struct {
+	timer    *time.Timer
+	deadline time.Time // zero if the call can be postponed indefinitely
+	fn       func() output
+
+	done   chan struct{}
+	result output
+}
+
+func newDebouncer(wait, maxWait time.Duration) *debouncer {
+	return &debouncer{wait: wait, maxWait: maxWait}
+}
+
+// do schedules fn to run after the quiet interval and blocks until the
+// execution of the current burst completes. The function of the latest
+// caller in the burst is the one that runs, and every caller receives
+// its result.
+func (d *debouncer) do(fn func() output) output {
+	d.mu.Lock()
+	call := d.pending
+	if call == nil {
+		call = &debounceCall{done: make(chan struct{})}
+		if d.maxWait > 0 {
+			call.deadline = time.Now().Add(d.maxWait)
+		}
+		call.timer = time.AfterFunc(d.wait, func() { d.fire(call) })
+		d.pending = call
+	} else {
+		delay := d.wait
+		if !call.deadline.IsZero() {
+			if remaining := time.Until(call.deadline); remaining < delay {
+				delay = remaining
+			}
+		}
+		call.timer.Reset(delay)
+	}
+	call.fn = fn
+	d.mu.Unlock()
+
+	<-call.done
+	return call.result
+}
+
+func (d *debouncer) fire(call *debounceCall) {
+	d.mu.Lock()
+	if d.pending != call {
+		// already fired, this is a stale timer.
+		d.mu.Unlock()
+		return
+	}
+	d.pending = nil
+	fn := call.fn
+	d.mu.Unlock()
+
+	call.result = fn()
+	close(call.done)
+}
@@ -0,0 +1,98 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// flushWriter flushes each write to the client.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, f.rc.Flush()
+}
+
+// streamDuplex runs the command with the request body as its standard
+// input while its standard output is streamed as the response body.
+// The exit code is sent in the X-Exec-Exit-Code trailer.
+func (m Middleware) streamDuplex(w http.ResponseWriter, r *http.Request, argv []string) error {
+	rc := http.NewResponseController(w)
+	if err := rc.EnableFullDuplex(); err != nil && r.ProtoMajor < 2 {
+		// HTTP/2 requests are always full-duplex.
+		return caddyhttp.Error(http.StatusHTTPVersionNotSupported, fmt.Errorf("full-duplex unsupported: %v", err))
+	}
+
+	ctx := r.Context()
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Trailer", "X-Exec-Exit-Code")
+
+	errWriter := m.stdWriter
+	if m.errWriter != nil {
+		errWriter = m.errWriter
+	}
+	id := executionID(ctx)
+	stdoutWriter, flushStdout := m.mirrorOutput(flushWriter{w: w, rc: rc}, id, "stdout")
+	stderrWriter, flushStderr := m.mirrorOutput(errWriter, id, "stderr")
+	defer flushStdout()
+	defer flushStderr()
+
+	var stdin io.WriteCloser
+	cmd, err := m.start(ctx, argv, func() (*exec.Cmd, error) {
+		cmd := m.command(ctx, argv)
+		cmd.Stdout = stdoutWriter
+		cmd.Stderr = stderrWriter
+
+		var err error
+		stdin, err = cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		return cmd, nil
+	})
+	if err != nil {
+		m.log.Error("starting command", zap.String("command", m.Command), zap.Strings("args", argv), zap.Error(err))
+		return handlerError(err)
+	}
+
+	// the standard input is closed once the client is done sending,
+	// or by Wait once the command exited.
+	go func() {
+		_, err := io.Copy(stdin, r.Body)
+		if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			m.log.Debug("copying request body", zap.Error(err))
+		}
+		stdin.Close()
+	}()
+
+	err = m.wait(cmd)
+	if err != nil {
+		m.log.Error("command finished with error", zap.Error(err))
+	}
+	// unblock the copy if the client is still sending.
+	r.Body.Close()
+
+	w.Header().Set("X-Exec-Exit-Code", strconv.Itoa(exitCode(err)))
+	return nil
+}
@@ -0,0 +1,116 @@
+package command
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os/exec"
+
+	"go.uber.org/zap"
+)
+
+// framingLengthPrefixed streams the standard output as binary frames
+// instead of Server-Sent Events.
+const framingLengthPrefixed = "length-prefixed"
+
+// frameWriter writes each chunk of output as a frame: its length as a
+// 4-byte big-endian unsigned integer, followed by the raw bytes.
+type frameWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (f frameWriter) Write(p []byte) (int, error) {
+	// a zero-length frame marks the end of the output.
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := f.frame(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f frameWriter) frame(p []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(p)))
+	if _, err := f.w.Write(length[:]); err != nil {
+		return err
+	}
+	if _, err := f.w.Write(p); err != nil {
+		return err
+	}
+	f.flusher.Flush()
+	return nil
+}
+
+// streamFrames runs the command and streams its standard output as
+// length-prefixed frames, followed by a zero-length frame and a status
+// frame. The standard error is written to the command's logs.
+func (m Middleware) streamFrames(w http.ResponseWriter, r *http.Request, argv []string, stdin io.Reader) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		m.log.Error("streaming unsupported")
+		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		return nil
+	}
+
+	ctx := r.Context()
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	errWriter := m.stdWriter
+	if m.errWriter != nil {
+		errWriter = m.errWriter
+	}
+	frames := frameWriter{w: w, flusher: flusher}
+	id := executionID(ctx)
+	stdoutWriter, flushStdout := m.mirrorOutput(frames, id, "stdout")
+	stderrWriter, flushStderr := m.mirrorOutput(errWriter, id, "stderr")
+	defer flushStdout()
+	defer flushStderr()
+
+	cmd, err := m.start(ctx, argv, func() (*exec.Cmd, error) {
+		cmd := m.command(ctx, argv)
+		cmd.Stdin = stdin
+		cmd.Stdout = stdoutWriter
+		cmd.Stderr = stderrWriter
+		return cmd, nil
+	})
+	if err != nil {
+		m.log.Error("starting command", zap.String("command", m.Command), zap.Strings("args", argv), zap.Error(err))
+		return handlerError(err)
+	}
+
+	err = m.wait(cmd)
+	if err != nil {
+		m.log.Error("command finished with error", zap.Error(err))
+	}
+
+	var status struct {
+		ExitCode int    `json:"exit_code"`
+		Error    string `json:"error,omitempty"`
+	}
+	status.ExitCode = exitCode(err)
+	if err != nil {
+		status.Error = err.Error()
+	}
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	// errors writing the final frames mean the client is gone.
+	if _, err := w.Write(make([]byte, 4)); err == nil {
+		_ = frames.frame(b)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// historyOutputLimit is the maximum size of the standard output and of
+// the standard error kept per execution.
+const historyOutputLimit = 4 << 10
+
+// historyEntry is a completed execution kept in the history.
+type historyEntry struct {
+	Time      time.Time `json:"time"`
+	Duration  string    `json:"duration"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	ExitCode  int       `json:"exit_code"`
+	Stdout    string    `json:"stdout,omitempty"`
+	Stderr    string    `json:"stderr,omitempty"`
+	Truncated bool      `json:"truncated,omitempty"`
+}
+
+// history keeps the last completed executions of a command in a ring
+// buffer.
+type history struct {
+	command string
+	args    []string
+
+	mu      sync.Mutex
+	entries []historyEntry
+	next    int // index of the oldest entry once full
+}
+
+func newHistory(c *Cmd) *history {
+	return &history{
+		command: c.Command,
+		args:    c.Args,
+		entries: make([]historyEntry, 0, c.KeepHistory),
+	}
+}
+
+// record adds the execution started at started that exited with code
+// to the history, with err if it failed. stdout and stderr are nil if
+// the output of the command is not collected.
+func (h *history) record(started time.Time, code int, err error, stdout, stderr *limitedBuffer) {
+	if h == nil {
+		return
+	}
+
+	entry := historyEntry{
+		Time:     started,
+		Duration: time.Since(started).String(),
+		Status:   "success",
+		ExitCode: code,
+	}
+	if err != nil {
+		entry.Status = "error"
+		entry.Error = err.Error()
+	}
+	for _, out := range []struct {
+		buf *limitedBuffer
+		s   *string
+	}{{stdout, &entry.Stdout}, {stderr, &entry.Stderr}} {
+		if out.buf == nil {
+			continue
+		}
+		b := out.buf.buf.Bytes()
+		if len(b) > historyOutputLimit {
+			b = b[:historyOutputLimit]
+			entry.Truncated = true
+		}
+		*out.s = string(b)
+		entry.Truncated = entry.Truncated || out.buf.exceeded
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.entries) < cap(h.entries) {
+		h.entries = append(h.entries, entry)
+		return
+	}
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % len(h.entries)
+}
+
+// list returns the entries from the most recent.
+func (h *history) list() []historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entries := make([]historyEntry, 0, len(h.entries))
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		entries = append(entries, h.entries[(h.next+i)%len(h.entries)])
+	}
+	return entries
+}
+
+// histories are the histories of the provisioned commands.
+var histories = struct {
+	mu sync.Mutex
+	m  map[*history]struct{}
+}{m: map[*history]struct{}{}}
+
+func addHistory(h *history) {
+	histories.mu.Lock()
+	defer histories.mu.Unlock()
+	histories.m[h] = struct{}{}
+}
+
+func removeHistory(h *history) {
+	histories.mu.Lock()
+	defer histories.mu.Unlock()
+	delete(histories.m, h)
+}
+
+// serveHistory serves the history of the commands with KeepHistory.
+func serveHistory(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	type commandHistory struct {
+		Command    string         `json:"command"`
+		Args       []string       `json:"args"`
+		Executions []historyEntry `json:"executions"`
+	}
+	resp := []commandHistory{}
+
+	histories.mu.Lock()
+	for h := range histories.m {
+		resp = append(resp, commandHistory{
+			Command:    h.command,
+			Args:       h.args,
+			Executions: h.list(),
+		})
+	}
+	histories.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
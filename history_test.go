@@ -0,0 +1,19 @@
+package command
+
+import "testing"
+
+func TestCleanupRemovesStepHistory(t *testing.T) {
+	m := newTestMiddleware(t, "exec {\n step echo a {\n keep_history 5\n }\n}")
+	h := m.Steps[0].history
+	if h == nil {
+		t.Fatal("the step has no history")
+	}
+
+	m.Cleanup()
+
+	histories.mu.Lock()
+	defer histories.mu.Unlock()
+	if _, ok := histories.m[h]; ok {
+		t.Error("the history of the step is still served after cleanup")
+	}
+}
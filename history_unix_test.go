@@ -0,0 +1,38 @@
+//go:build unix
+
+package command
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHistoryExitSemantics(t *testing.T) {
+	for name, input := range map[string]string{
+		"foreground": "exec sh -c \"echo line; exit 1\" {\n foreground\n exit_semantics grep\n keep_history 5\n cooldown 1m\n}",
+		"pipe_to":    "exec sh -c \"echo line; exit 1\" {\n foreground\n pipe_to cat\n exit_semantics grep\n keep_history 5\n cooldown 1m\n}",
+		"truncated":  "exec sh -c \"yes | head -c 100000\" {\n foreground\n max_output 10\n keep_history 5\n cooldown 1m\n}",
+	} {
+		t.Run(name, func(t *testing.T) {
+			m := newTestMiddleware(t, input)
+			w, err := serveTest(m, newTestRequest(http.MethodGet, "/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+
+			entries := m.history.list()
+			if len(entries) != 1 {
+				t.Fatalf("%d history entries", len(entries))
+			}
+			if entries[0].Status != "success" {
+				t.Errorf("the execution is recorded as %s: %s", entries[0].Status, entries[0].Error)
+			}
+			if _, ok := m.cooldown.allowed(); ok {
+				t.Error("the cooldown did not start")
+			}
+		})
+	}
+}
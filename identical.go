@@ -0,0 +1,92 @@
+package command
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+// errTooManyIdentical is returned when a command is rejected, as the
+// maximum number of identical runs is reached.
+var errTooManyIdentical = errors.New("too many identical commands running")
+
+// identicalKey returns the key identifying the runs of command with argv.
+func identicalKey(command string, argv []string) string {
+	h := sha256.New()
+	h.Write([]byte(command))
+	for _, arg := range argv {
+		h.Write([]byte{0})
+		h.Write([]byte(arg))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// keyedLimiter bounds the number of concurrent runs per key. The slots
+// of a key are dropped once no run holds or waits for them.
+type keyedLimiter struct {
+	limit int
+
+	mu   sync.Mutex
+	keys map[string]*keySlots
+}
+
+type keySlots struct {
+	slots chan struct{}
+	refs  int // runs holding or waiting for a slot
+}
+
+func newKeyedLimiter(limit int) *keyedLimiter {
+	return &keyedLimiter{limit: limit, keys: map[string]*keySlots{}}
+}
+
+// acquire takes a slot of key. If none is free, it blocks until one is
+// released or ctx is done if wait is true, otherwise it returns
+// errTooManyIdentical.
+func (l *keyedLimiter) acquire(ctx context.Context, key string, wait bool) error {
+	l.mu.Lock()
+	k, ok := l.keys[key]
+	if !ok {
+		k = &keySlots{slots: make(chan struct{}, l.limit)}
+		l.keys[key] = k
+	}
+	k.refs++
+	l.mu.Unlock()
+
+	if wait {
+		select {
+		case k.slots <- struct{}{}:
+			return nil
+		case <-ctx.Done():
+			l.unref(key, k)
+			return ctx.Err()
+		}
+	}
+	select {
+	case k.slots <- struct{}{}:
+		return nil
+	default:
+		l.unref(key, k)
+		return errTooManyIdentical
+	}
+}
+
+// release frees a slot of key taken by acquire.
+func (l *keyedLimiter) release(key string) {
+	l.mu.Lock()
+	k := l.keys[key]
+	l.mu.Unlock()
+
+	<-k.slots
+	l.unref(key, k)
+}
+
+func (l *keyedLimiter) unref(key string, k *keySlots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	k.refs--
+	if k.refs == 0 {
+		delete(l.keys, key)
+	}
+}
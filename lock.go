@@ -0,0 +1,14 @@
+package command
+
+import (
+	"errors"
+)
+
+// errLocked is returned when a command is rejected, as another run held
+// its lock for longer than LockTimeout.
+var errLocked = errors.New("lock held by another run")
+
+// locks are the locks of the commands with LockKey. They are shared by
+// all the commands and survive config reloads, so that runs started
+// before a reload keep holding them. Idle locks are dropped.
+var locks = newKeyedLimiter(1)
@@ -0,0 +1,45 @@
+//go:build unix
+
+package command
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestLockKey(t *testing.T) {
+	for _, mode := range []string{"foreground", "background"} {
+		t.Run(mode, func(t *testing.T) {
+			input := "exec sleep 1 {\n lock_key test-" + mode + "-{http.request.uri.path.0} 100ms\n}"
+			if mode == "foreground" {
+				input = "exec sleep 1 {\n foreground\n lock_key test-" + mode + "-{http.request.uri.path.0} 100ms\n}"
+			}
+			m := newTestMiddleware(t, input)
+
+			// the first request holds the lock of /a while its command runs
+			done := make(chan error, 1)
+			go func() {
+				_, err := serveTest(m, newTestRequest(http.MethodGet, "/a", nil))
+				done <- err
+			}()
+			waitRunning(t, m.running)
+
+			_, err := serveTest(m, newTestRequest(http.MethodGet, "/a", nil))
+			var handlerErr caddyhttp.HandlerError
+			if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusConflict {
+				t.Errorf("a request with the same key is not rejected with 409: %v", err)
+			}
+
+			if _, err := serveTest(m, newTestRequest(http.MethodGet, "/b", nil)); err != nil {
+				t.Errorf("a request with another key is rejected: %v", err)
+			}
+
+			if err := <-done; err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package command
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// metadata is the data of the "meta" event sent before the output with
+// MetadataFrame.
+type metadata struct {
+	ExecutionID string    `json:"execution_id"`
+	Command     string    `json:"command"`
+	Args        []string  `json:"args"`
+	Start       time.Time `json:"start"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	RemoteAddr  string    `json:"remote_addr"`
+}
+
+// writeMetadata sends the "meta" event describing the execution of the
+// configured command for r.
+func (m Middleware) writeMetadata(w http.ResponseWriter, flusher http.Flusher, r *http.Request, command string) {
+	// the configured command and args, values of the request such as
+	// tokens must not be echoed back.
+	args := m.Args
+	if args == nil {
+		args = []string{}
+	}
+	data, err := json.Marshal(metadata{
+		ExecutionID: executionID(r.Context()),
+		Command:     command,
+		Args:        args,
+		Start:       time.Now(),
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		RemoteAddr:  r.RemoteAddr,
+	})
+	if err != nil {
+		m.log.Error("encoding metadata", zap.Error(err))
+		return
+	}
+	writeEvent(w, "meta", string(data))
+	flusher.Flush()
+}
@@ -0,0 +1,62 @@
+//go:build unix
+
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestMetadataConfiguredCommand(t *testing.T) {
+	m := newTestMiddleware(t, "exec {http.vars.tool} {http.vars.arg} {\n stream\n metadata_frame\n}")
+
+	r := newTestRequest(http.MethodGet, "/", nil)
+	caddyhttp.SetVar(r.Context(), "tool", "echo")
+	caddyhttp.SetVar(r.Context(), "arg", "secret")
+	w, err := serveTest(m, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := w.Body.String()
+	data, ok := strings.CutPrefix(body, "event: meta\ndata: ")
+	if !ok {
+		t.Fatalf("the stream does not start with the meta event:\n%s", body)
+	}
+	var meta metadata
+	if err := json.Unmarshal([]byte(data[:strings.IndexByte(data, '\n')]), &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Command != "{http.vars.tool}" || len(meta.Args) != 1 || meta.Args[0] != "{http.vars.arg}" {
+		t.Errorf("the meta event is not of the configured command: %q %q", meta.Command, meta.Args)
+	}
+}
+
+func TestMetadataRejectedRequest(t *testing.T) {
+	m := newTestMiddleware(t, "exec sleep 1 {\n stream\n metadata_frame\n lock_key test-metadata 100ms\n}")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := serveTest(m, newTestRequest(http.MethodGet, "/", nil))
+		done <- err
+	}()
+	waitRunning(t, m.running)
+
+	w, err := serveTest(m, newTestRequest(http.MethodGet, "/", nil))
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusConflict {
+		t.Errorf("the request is not rejected with 409: %v", err)
+	}
+	if w.Flushed || w.Body.Len() > 0 {
+		t.Errorf("the response of the rejected request started:\n%s", w.Body)
+	}
+
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
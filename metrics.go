@@ -0,0 +1,61 @@
+package command
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// lineGap is the histogram of the time between consecutive lines of
+// the streamed output of commands.
+var (
+	lineGap     *prometheus.HistogramVec
+	lineGapOnce sync.Once
+)
+
+// registerLineGap registers the line gap histogram to the metrics
+// registry of ctx and returns it. All the commands share it, each one
+// with its own labels.
+func registerLineGap(ctx caddy.Context) (*prometheus.HistogramVec, error) {
+	lineGapOnce.Do(func() {
+		lineGap = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "caddy",
+			Subsystem: "exec",
+			Name:      "line_gap_seconds",
+			Help:      "Time between consecutive lines of the streamed output of commands.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"command", "stream"})
+	})
+
+	registry := ctx.GetMetricsRegistry()
+	if registry == nil {
+		return lineGap, nil
+	}
+	// the histogram is registered once per config, by its first command.
+	err := registry.Register(lineGap)
+	if err != nil && !errors.As(err, new(prometheus.AlreadyRegisteredError)) {
+		return nil, err
+	}
+	return lineGap, nil
+}
+
+// lineGapObserver returns a function to call for each line of the
+// stream that records the time since the previous line. It is nil if
+// line gap metrics are disabled.
+func (c *Cmd) lineGapObserver(stream string) func() {
+	if c.lineGap == nil {
+		return nil
+	}
+	observer := c.lineGap.WithLabelValues(c.Command, stream)
+	var last time.Time
+	return func() {
+		now := time.Now()
+		if !last.IsZero() {
+			observer.Observe(now.Sub(last).Seconds())
+		}
+		last = now
+	}
+}
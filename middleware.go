@@ -2,13 +2,17 @@ package command
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os/exec"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
@@ -19,6 +23,7 @@ var (
 	_ caddy.Module                = (*Middleware)(nil)
 	_ caddy.Provisioner           = (*Middleware)(nil)
 	_ caddy.Validator             = (*Middleware)(nil)
+	_ caddy.CleanerUpper          = (*Middleware)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Middleware)(nil)
 )
 
@@ -49,19 +54,76 @@ func (m Middleware) Validate() error { return m.Cmd.validate() }
 func (m Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
 
-	// replace per-request placeholders
-	argv := make([]string, len(m.Args))
-	for index, argument := range m.Args {
-		argv[index] = repl.ReplaceAll(argument, "")
+	if m.BodyToTempFile {
+		remove, err := m.writeBodyFile(r, repl)
+		if err != nil {
+			return err
+		}
+		// commands run in the background are rejected by Validate,
+		// the file is no longer used once the command completed.
+		defer remove()
+	}
+
+	// replace per-request placeholders, m is a copy owned by the request
+	configured := m.Command
+	m.Command = m.replaceCommand(repl)
+	m.PipeTo = m.replacePipeTo(repl)
+	argv := m.replaceArgs(repl)
+	if err := m.checkCommandPaths(repl); err != nil {
+		return caddyhttp.Error(http.StatusForbidden, err)
+	}
+
+	if m.prober != nil {
+		return m.serveProbe(w, r, argv)
+	}
+
+	if next, ok := m.cooldown.allowed(); !ok {
+		return m.serveCooldown(w, next)
+	}
+
+	stdin, err := m.requestStdin(r)
+	if err != nil {
+		return err
+	}
+	if m.StdinFile != "" {
+		f, err := m.requestStdinFile(repl)
+		if err != nil {
+			return err
+		}
+		// the command has its own descriptor once started.
+		defer f.Close()
+		stdin = f
+	}
+
+	// the command may still be reading the request body when the
+	// response is written, HTTP/1 closes it otherwise.
+	bodyIsStdin := !m.RequestToStdin && m.StdinFile == "" && !m.BodyToTempFile
+	runsInRequest := m.Foreground || m.Stream || len(m.Steps) > 0 || m.streamAfter > 0
+	if bodyIsStdin && runsInRequest && r.ProtoMajor < 2 {
+		if err := http.NewResponseController(w).EnableFullDuplex(); err != nil {
+			m.log.Debug("full duplex unsupported, the request body may not be read once the response started", zap.Error(err))
+		}
 	}
 
 	if !m.Stream {
+		// steps always run in the foreground
+		if len(m.Steps) > 0 {
+			return m.runSteps(w, r, stdin, next)
+		}
+
+		// switches to streaming if the command is still running
+		if m.streamAfter > 0 {
+			return m.runAndStreamAfter(w, r, argv, stdin)
+		}
+
 		// If foreground mode, collect all output and return it
 		if m.Foreground {
-			return m.runAndCollectOutput(w, r, argv, next)
+			return m.runAndCollectOutput(w, r, argv, stdin, next)
 		}
 
-		err := m.runWithInput(argv, r.Body)
+		err := m.execute(func() output {
+			return output{err: m.runWithInput(r.Context(), argv, stdin)}
+		}).err
 
 		if m.PassThru {
 			if err != nil {
@@ -71,22 +133,36 @@ func (m Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddy
 			return next.ServeHTTP(w, r)
 		}
 
+		if rejected(err) {
+			return handlerError(err)
+		}
+
 		var resp struct {
 			Status string `json:"status,omitempty"`
 			Error  string `json:"error,omitempty"`
 		}
 
+		status := m.successStatus()
 		if err == nil {
 			resp.Status = "success"
 		} else {
-			w.WriteHeader(http.StatusInternalServerError)
+			status = http.StatusInternalServerError
 			resp.Error = err.Error()
 		}
 
 		w.Header().Add("content-type", "application/json")
+		w.WriteHeader(status)
 		return json.NewEncoder(w).Encode(resp)
 	}
 
+	if m.Duplex {
+		return m.streamDuplex(w, r, argv)
+	}
+
+	if m.Framing == framingLengthPrefixed {
+		return m.streamFrames(w, r, argv, stdin)
+	}
+
 	// The rest of the function is the new SSE logic
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -99,138 +175,530 @@ func (m Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddy
 		return nil
 	}
 
-	ctx := r.Context()
-	if m.timeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, m.timeout)
-		defer cancel()
+	if len(m.Steps) > 0 {
+		m.streamSteps(w, flusher, r, stdin)
+		return nil
 	}
 
-	cmd := exec.CommandContext(ctx, m.Command, argv...)
-	cmd.Dir = m.Directory
-	cmd.Stdin = r.Body
+	var started func()
+	if m.MetadataFrame {
+		started = func() { m.writeMetadata(w, flusher, r, configured) }
+	}
 
-	stdout, err := cmd.StdoutPipe()
+	wait, err := m.startStream(r.Context(), w, flusher, argv, stdin, "", nil, started)
 	if err != nil {
-		m.log.Error("getting stdout pipe", zap.Error(err))
-		return err
+		return handlerError(err)
 	}
 
-	stderr, err := cmd.StderrPipe()
+	err = wait()
 	if err != nil {
-		m.log.Error("getting stderr pipe", zap.Error(err))
-		return err
+		m.log.Error("command finished with error", zap.Error(err))
+	}
+	m.writeFinalEvents(w, flusher, err)
+	return nil
+}
+
+// writeFinalEvents ends the event stream of a command that completed
+// with err.
+func (m Middleware) writeFinalEvents(w io.Writer, flusher http.Flusher, err error) {
+	// a mapped exit code replaces the default final events
+	if event, ok := m.ExitCodeEvents[exitCode(err)]; ok {
+		fmt.Fprintf(w, "event: %s\ndata: %d\n\n", event, exitCode(err))
+		flusher.Flush()
+		return
 	}
 
-	err = cmd.Start()
 	if err != nil {
-		m.log.Error("starting command", zap.String("command", m.Command), zap.Strings("args", argv), zap.Error(err))
-		return err
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", err.Error())
+		flusher.Flush()
+	}
+
+	// Send a final event to signal completion
+	fmt.Fprintf(w, "event: close\ndata: Command finished\n\n")
+	flusher.Flush()
+}
+
+// startStream starts the command and streams its output as Server-Sent
+// Events, whose names are prefixed with prefix. If stdoutCopy is not nil,
+// the lines of the standard output are also written to it. If started is
+// not nil, it is called once the command started, before any event.
+// The returned function waits for the command to complete and returns
+// its error.
+func (c *Cmd) startStream(ctx context.Context, w io.Writer, flusher http.Flusher, argv []string, stdin io.Reader, prefix string, stdoutCopy io.Writer, started func()) (wait func() error, err error) {
+	cancel := func() {}
+	if c.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
 	}
 
+	var stdout, stderr io.ReadCloser
+	cmd, err := c.start(ctx, argv, func() (*exec.Cmd, error) {
+		cmd := c.command(ctx, argv)
+		cmd.Stdin = stdin
+
+		var err error
+		stdout, err = cmd.StdoutPipe()
+		if err != nil {
+			c.log.Error("getting stdout pipe", zap.Error(err))
+			return nil, err
+		}
+
+		stderr, err = cmd.StderrPipe()
+		if err != nil {
+			c.log.Error("getting stderr pipe", zap.Error(err))
+			return nil, err
+		}
+		return cmd, nil
+	})
+	if err != nil {
+		cancel()
+		if cmd != nil {
+			c.log.Error("starting command", zap.String("command", c.Command), zap.Strings("args", argv), zap.Error(err))
+		}
+		return nil, err
+	}
+	if started != nil {
+		started()
+	}
+
+	// writes of both goroutines must not interleave
+	var mu sync.Mutex
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	// Goroutine for stdout
-	go func() {
-		defer wg.Done()
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			fmt.Fprintf(w, "event: stdout\ndata: %s\n\n", scanner.Text())
-			flusher.Flush()
-		}
-	}()
+	var stats *streamStats
+	if c.statsInterval > 0 {
+		stats = c.startStats(ctx, w, flusher, &mu, prefix)
+	}
 
-	// Goroutine for stderr
-	go func() {
+	id := executionID(ctx)
+	scan := func(r io.Reader, event string, copy io.Writer) {
 		defer wg.Done()
-		scanner := bufio.NewScanner(stderr)
+		mirror, flushMirror := c.mirrorOutput(copy, id, event)
+		defer flushMirror()
+
+		observeLine := c.lineGapObserver(event)
+		scanner := bufio.NewScanner(c.decodeReader(r))
 		for scanner.Scan() {
-			fmt.Fprintf(w, "event: stderr\ndata: %s\n\n", scanner.Text())
+			if observeLine != nil {
+				observeLine()
+			}
+			stats.line(len(scanner.Bytes()))
+			mu.Lock()
+			writeEvent(w, prefix+event, c.formatLine(event, scanner.Text()))
 			flusher.Flush()
+			mu.Unlock()
+			if mirror != nil {
+				fmt.Fprintln(mirror, scanner.Text())
+			}
 		}
-	}()
+		c.drain(r, event, scanner.Err())
+	}
+	go scan(stdout, "stdout", stdoutCopy)
+	go scan(stderr, "stderr", nil)
 
-	wg.Wait()
+	return func() error {
+		defer cancel()
+		wg.Wait()
+		stats.stop()
+		return c.wait(cmd)
+	}, nil
+}
 
-	err = cmd.Wait()
-	if err != nil {
-		m.log.Error("command finished with error", zap.Error(err))
-		fmt.Fprintf(w, "event: error\ndata: %s\n\n", err.Error())
-		flusher.Flush()
+// drain discards the rest of the output of a command once its scanner
+// stopped with err, e.g. on a line too long, so that the command does not
+// block on a full pipe and can be waited for.
+func (c *Cmd) drain(r io.Reader, stream string, err error) {
+	if err == nil {
+		return
 	}
+	c.log.Error("reading output, the rest is discarded", zap.String("stream", stream), zap.Error(err))
+	io.Copy(io.Discard, r)
+}
 
-	// Send a final event to signal completion
-	fmt.Fprintf(w, "event: close\ndata: Command finished\n\n")
-	flusher.Flush()
-
-	return nil
+// writeEvent writes a Server-Sent Event, data spanning multiple lines
+// is split into multiple data fields.
+func writeEvent(w io.Writer, event, data string) {
+	fmt.Fprintf(w, "event: %s\n", event)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
 }
 
 // runAndCollectOutput runs the command in foreground mode, collects all output,
 // and returns it to the client in a single response.
-func (m Middleware) runAndCollectOutput(w http.ResponseWriter, r *http.Request, argv []string, next caddyhttp.Handler) error {
+func (m Middleware) runAndCollectOutput(w http.ResponseWriter, r *http.Request, argv []string, stdin io.Reader, next caddyhttp.Handler) error {
 	if m.PassThru {
 		// In pass-thru mode, just run and continue
-		err := m.run(argv)
+		err := m.execute(func() output {
+			return output{err: m.run(r.Context(), argv)}
+		}).err
 		if err != nil {
 			m.log.Error(err.Error())
 		}
 		return next.ServeHTTP(w, r)
 	}
 
-	ctx := r.Context()
-	if m.timeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, m.timeout)
-		defer cancel()
+	ctx := m.runContext(r)
+	if m.debouncer != nil {
+		// a debounced run is shared by every request of the burst,
+		// it must not depend on the request that triggered it.
+		ctx = context.WithValue(context.WithoutCancel(ctx), clientCtxKey{}, nil)
+	}
+
+	// heartbeats commit the response status before the command completes.
+	var stopHeartbeat func()
+	if m.heartbeat > 0 {
+		stopHeartbeat = m.startHeartbeat(w)
 	}
 
-	cmd := exec.CommandContext(ctx, m.Command, argv...)
-	cmd.Dir = m.Directory
-	cmd.Stdin = r.Body
+	var out output
+	if m.responseDeadline > 0 {
+		out = m.collectOutputUntilDeadline(r, argv, stdin)
+	} else {
+		out = m.execute(func() output {
+			return m.collectOutput(ctx, argv, stdin)
+		})
+	}
 
-	// Create buffers to collect output
-	var stdoutBuf, stderrBuf bytes.Buffer
-	cmd.Stdout = &stdoutBuf
-	cmd.Stderr = &stderrBuf
+	if stopHeartbeat != nil {
+		stopHeartbeat()
+	} else if rejected(out.err) {
+		return handlerError(out.err)
+	}
 
-	// Start and wait for command to complete
-	err := cmd.Run()
+	if m.StderrFails && out.err == nil && !out.partial && len(out.stderr) > 0 {
+		out.err = errStderrOutput
+	}
 
+	if m.ExitCodeOnly {
+		w.WriteHeader(m.exitCodeStatus(out.exitCode, out.err))
+		return nil
+	}
+
+	// heartbeats already sent the headers
+	return m.writeOutput(w, out, stopHeartbeat == nil)
+}
+
+// writeOutput responds with the JSON result of a command that completed
+// with out. The status and headers are only written if writeHeader is
+// true.
+func (m Middleware) writeOutput(w http.ResponseWriter, out output, writeHeader bool) error {
 	// Prepare response with collected output
 	var resp struct {
-		Status   string `json:"status"`
-		Error    string `json:"error,omitempty"`
-		Stdout   string `json:"stdout"`
-		Stderr   string `json:"stderr"`
-		ExitCode int    `json:"exit_code"`
+		Status    string `json:"status"`
+		Error     string `json:"error,omitempty"`
+		Stdout    string `json:"stdout"`
+		Stderr    string `json:"stderr"`
+		ExitCode  int    `json:"exit_code"`
+		Truncated bool   `json:"truncated,omitempty"`
+		TimedOut  bool   `json:"timed_out,omitempty"`
+		Partial   bool   `json:"partial,omitempty"`
+
+		// exit code of the PipeTo command, with exit_code the one of
+		// the command.
+		PipeExitCode *int `json:"pipe_exit_code,omitempty"`
+
+		// not nil with OutputLines, even without output
+		StdoutLines []string `json:"stdout_lines,omitzero"`
+		StderrLines []string `json:"stderr_lines,omitzero"`
 	}
 
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	status := m.successStatus()
+	if err := out.err; err != nil {
+		status = http.StatusInternalServerError
 		resp.Error = err.Error()
 		resp.Status = "error"
-		if exitError, ok := err.(*exec.ExitError); ok {
-			resp.ExitCode = exitError.ExitCode()
-		} else {
-			resp.ExitCode = -1
-		}
+	} else if out.partial {
+		status = http.StatusAccepted
+		resp.Status = "running"
 	} else {
 		resp.Status = "success"
-		resp.ExitCode = 0
+	}
+	resp.ExitCode = out.exitCode
+	if len(m.PipeTo) > 0 {
+		resp.PipeExitCode = &out.pipeExitCode
 	}
 
 	// Add collected output
-	resp.Stdout = stdoutBuf.String()
-	resp.Stderr = stderrBuf.String()
+	resp.Stdout = string(out.stdout)
+	resp.Stderr = string(out.stderr)
+	resp.Truncated = out.truncated
+	resp.TimedOut = out.timedOut
+	resp.Partial = out.partial
+	if m.OutputLines {
+		resp.StdoutLines = splitLines(resp.Stdout)
+		resp.StderrLines = splitLines(resp.Stderr)
+	}
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if writeHeader {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("X-Exec-Stdout-Bytes", strconv.FormatInt(out.stdoutBytes, 10))
+		w.Header().Set("X-Exec-Stderr-Bytes", strconv.FormatInt(out.stderrBytes, 10))
+		w.Header().Set("X-Exec-Truncated", strconv.FormatBool(out.truncated))
+		w.WriteHeader(status)
+	}
 	return json.NewEncoder(w).Encode(resp)
 }
 
+// statusClientClosedRequest is the non-standard status of responses to
+// clients that went away, which do not get it.
+const statusClientClosedRequest = 499
+
+// rejected reports whether err rejected a command before it started,
+// the request is then handled with handlerError.
+func rejected(err error) bool {
+	return errors.Is(err, errTooManyIdentical) || errors.Is(err, errLocked) || errors.Is(err, errAbandoned)
+}
+
+// handlerError returns the error to handle a request whose command
+// failed to start with err.
+func handlerError(err error) error {
+	if errors.Is(err, errTooManyIdentical) {
+		return caddyhttp.Error(http.StatusServiceUnavailable, err)
+	}
+	if errors.Is(err, errLocked) {
+		return caddyhttp.Error(http.StatusConflict, err)
+	}
+	if errors.Is(err, errAbandoned) {
+		// as the reverse proxy does for clients gone
+		return caddyhttp.Error(statusClientClosedRequest, err)
+	}
+	return err
+}
+
+// runContext returns the context to run a buffered command for r with.
+// Unless CancelOnDisconnect is set, the command keeps running when the
+// client goes away, so that it completes its side effects.
+func (m Middleware) runContext(r *http.Request) context.Context {
+	if m.CancelOnDisconnect {
+		return r.Context()
+	}
+	// commands that did not start yet are abandoned with the client
+	return context.WithValue(context.WithoutCancel(r.Context()), clientCtxKey{}, r.Context())
+}
+
+// startHeartbeat sends the response headers and periodically writes a
+// heartbeat to the client until the returned function is called.
+func (m Middleware) startHeartbeat(w http.ResponseWriter) (stop func()) {
+	contentType := "application/x-ndjson"
+	if m.HeartbeatFormat == "whitespace" {
+		contentType = "application/json; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+
+	flush := func() {
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+	flush()
+
+	startTime := time.Now()
+	ticker := time.NewTicker(m.heartbeat)
+	quit := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+
+			if m.HeartbeatFormat == "whitespace" {
+				// leading whitespace keeps the body a valid JSON document.
+				io.WriteString(w, "\n")
+			} else {
+				json.NewEncoder(w).Encode(struct {
+					Heartbeat bool  `json:"heartbeat"`
+					ElapsedMs int64 `json:"elapsed_ms"`
+				}{true, time.Since(startTime).Milliseconds()})
+			}
+			flush()
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(quit)
+		<-done
+	}
+}
+
+// outputWaitDelay is how long to wait for the output to be closed once a
+// command whose output is collected exited or was killed.
+const outputWaitDelay = time.Second
+
+// output is the result of a command execution.
+type output struct {
+	stdout []byte
+	stderr []byte
+	err    error
+
+	// exit code of the command, which may not be 0 on success with
+	// ExitSemantics.
+	exitCode int
+	// exit code of the PipeTo command, if any.
+	pipeExitCode int
+
+	// size of the output read from the command, before decoding.
+	stdoutBytes int64
+	stderrBytes int64
+	truncated   bool
+	timedOut    bool // killed on timeout
+	partial     bool // collected until ResponseDeadline
+}
+
+// collectOutput runs the command and waits for it to complete,
+// collecting its standard output and standard error.
+func (c *Cmd) collectOutput(ctx context.Context, argv []string, stdin io.Reader) output {
+	return c.collectOutputTo(ctx, argv, stdin, &limitedBuffer{limit: c.MaxOutput}, &limitedBuffer{limit: c.MaxOutput})
+}
+
+// collectOutputTo is collectOutput with the output collected in stdoutBuf
+// and stderrBuf.
+func (c *Cmd) collectOutputTo(ctx context.Context, argv []string, stdin io.Reader, stdoutBuf, stderrBuf *limitedBuffer) output {
+	var timeoutCtx context.Context
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+		timeoutCtx = ctx
+	}
+
+	id := executionID(ctx)
+	stdoutWriter, flushStdout := c.mirrorOutput(stdoutBuf, id, "stdout")
+	stderrWriter, flushStderr := c.mirrorOutput(stderrBuf, id, "stderr")
+
+	// Start and wait for command to complete
+	var err, pipeErr error
+	if len(c.PipeTo) > 0 {
+		err, pipeErr = c.runPiped(ctx, argv, stdin, stdoutWriter, stderrWriter, stdoutBuf, stderrBuf)
+	} else {
+		var cmd *exec.Cmd
+		cmd, err = c.start(ctx, argv, func() (*exec.Cmd, error) {
+			cmd := c.command(ctx, argv)
+			cmd.Stdin = stdin
+			cmd.Stdout = stdoutWriter
+			cmd.Stderr = stderrWriter
+			// children left holding the output must not keep the
+			// request waiting once the command is killed.
+			cmd.WaitDelay = outputWaitDelay
+			return cmd, nil
+		})
+		if err == nil {
+			err = c.waitOutput(cmd, stdoutBuf, stderrBuf)
+		}
+	}
+	flushStdout()
+	flushStderr()
+
+	truncated := stdoutBuf.exceeded || stderrBuf.exceeded
+	code, err := c.exitResult(err, stdoutBuf, stderrBuf)
+
+	var pipeCode int
+	if len(c.PipeTo) > 0 {
+		if truncated && isTruncationError(pipeErr) {
+			pipeErr = nil
+		}
+		pipeCode = exitCode(pipeErr)
+		if err == nil && pipeErr != nil {
+			err = fmt.Errorf("pipe_to: %w", pipeErr)
+		}
+	}
+
+	return output{
+		stdout:       c.decodeBytes(stdoutBuf.buf.Bytes()),
+		stderr:       c.decodeBytes(stderrBuf.buf.Bytes()),
+		err:          err,
+		exitCode:     code,
+		pipeExitCode: pipeCode,
+		stdoutBytes:  int64(stdoutBuf.buf.Len()),
+		stderrBytes:  int64(stderrBuf.buf.Len()),
+		truncated:    truncated,
+		timedOut:     timeoutCtx != nil && timeoutCtx.Err() == context.DeadlineExceeded,
+	}
+}
+
+// splitLines splits output into lines, without their line endings.
+// The last line does not need to end with a newline.
+func splitLines(output string) []string {
+	lines := []string{}
+	if output == "" {
+		return lines
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+		lines = append(lines, strings.TrimSuffix(line, "\r"))
+	}
+	return lines
+}
+
+// errStderrOutput fails commands that wrote to the standard error with
+// StderrFails.
+var errStderrOutput = errors.New("command wrote to standard error")
+
+// exitCode returns the exit code of a command that completed with err.
+// It is -1 if the command did not exit normally.
+func exitCode(err error) int {
+	if err == nil || err == errStderrOutput {
+		return 0
+	}
+	if exitError, ok := err.(*exec.ExitError); ok {
+		return exitError.ExitCode()
+	}
+	return -1
+}
+
+// exitResult returns the exit code of a command that completed with err
+// and its error, if it failed according to ExitSemantics. stdout and
+// stderr are nil if the output of the command is not collected.
+func (c *Cmd) exitResult(err error, stdout, stderr *limitedBuffer) (int, error) {
+	// the command is expected to fail writing once the pipe is closed
+	if (stdout != nil && stdout.exceeded || stderr != nil && stderr.exceeded) && isTruncationError(err) {
+		return 0, nil
+	}
+	code := exitCode(err)
+	if err != nil && code > 0 && c.successExitCode(code) {
+		return code, nil
+	}
+	return code, err
+}
+
+// execute runs fn, collapsing bursts of requests into a single
+// execution if debouncing is enabled.
+func (m Middleware) execute(fn func() output) output {
+	if m.debouncer != nil {
+		return m.debouncer.do(fn)
+	}
+	return fn()
+}
+
+// checkCommandPaths returns an error if the command or one of the steps,
+// with their placeholders replaced by repl, must be an absolute path and
+// is not. Steps are checked before any of them runs.
+func (m Middleware) checkCommandPaths(repl *caddy.Replacer) error {
+	if len(m.Steps) == 0 {
+		return m.checkCommandPath()
+	}
+	for i := range m.Steps {
+		step := m.Steps[i]
+		step.Command = step.replaceCommand(repl)
+		if err := step.checkCommandPath(); err != nil {
+			return fmt.Errorf("step %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
 // Cleanup implements caddy.Cleanup
-// TODO: ensure all running processes are terminated.
+// The running processes of the command and its steps are killed, so that
+// none outlives the config they were started by.
 func (m *Middleware) Cleanup() error {
+	m.Cmd.kill()
+	m.Cmd.cleanup()
 	return nil
 }
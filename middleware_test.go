@@ -0,0 +1,56 @@
+package command
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// newTestMiddleware returns the handler configured by the Caddyfile
+// input, provisioned and validated. It is cleaned up with the test.
+func newTestMiddleware(t *testing.T, input string) *Middleware {
+	t.Helper()
+	h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+	handler, err := parseHandlerCaddyfileBlock(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := handler.(Middleware)
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := m.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Cleanup() })
+	return &m
+}
+
+// newTestRequest returns a request set up as by Caddy's HTTP server.
+func newTestRequest(method, target string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	ctx := context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{})
+	ctx = context.WithValue(ctx, caddyhttp.ExtraLogFieldsCtxKey, new(caddyhttp.ExtraLogFields))
+	r = r.WithContext(ctx)
+	caddyhttp.NewTestReplacer(r)
+	return r
+}
+
+// serveTest serves r with m, with an empty next handler.
+func serveTest(m *Middleware, r *http.Request) (*httptest.ResponseRecorder, error) {
+	w := httptest.NewRecorder()
+	err := m.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	return w, err
+}
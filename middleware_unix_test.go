@@ -0,0 +1,125 @@
+//go:build unix
+
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestStreamDrainsLongLines(t *testing.T) {
+	// a line longer than the scanner buffer, then more output than a
+	// pipe holds
+	const command = "exec sh -c \"printf %070000d 0; echo; head -c 200000 /dev/zero\" {\n foreground\n"
+	for name, input := range map[string]string{
+		"stream":       command + " stream\n}",
+		"stream_after": command + " stream_after 10s\n}",
+	} {
+		t.Run(name, func(t *testing.T) {
+			m := newTestMiddleware(t, input)
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := serveTest(m, newTestRequest(http.MethodGet, "/", nil))
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Error(err)
+				}
+			case <-time.After(5 * time.Second):
+				m.Cleanup()
+				t.Fatal("the command blocked writing its output")
+			}
+		})
+	}
+}
+
+func TestTimeoutPartialOutput(t *testing.T) {
+	m := newTestMiddleware(t, "exec sh -c \"echo partial; sleep 10\" {\n foreground\n timeout 300ms\n}")
+
+	start := time.Now()
+	w, err := serveTest(m, newTestRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("responded after %s", elapsed)
+	}
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d", w.Code)
+	}
+
+	var resp struct {
+		Stdout   string `json:"stdout"`
+		TimedOut bool   `json:"timed_out"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.TimedOut {
+		t.Error("the response is not timed_out")
+	}
+	if resp.Stdout != "partial\n" {
+		t.Errorf("stdout %q", resp.Stdout)
+	}
+}
+
+func TestVarsCommand(t *testing.T) {
+	for name, test := range map[string]struct {
+		input  string
+		tool   string
+		status int
+	}{
+		"relative": {
+			input:  "exec {http.vars.tool} {http.vars.arg} {\n foreground\n}",
+			tool:   "echo",
+			status: http.StatusOK,
+		},
+		"absolute required": {
+			input:  "exec {http.vars.tool} {http.vars.arg} {\n foreground\n require_absolute_path\n}",
+			tool:   "/bin/echo",
+			status: http.StatusOK,
+		},
+		"relative rejected": {
+			input:  "exec {http.vars.tool} {http.vars.arg} {\n foreground\n require_absolute_path\n}",
+			tool:   "echo",
+			status: http.StatusForbidden,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			m := newTestMiddleware(t, test.input)
+
+			r := newTestRequest(http.MethodGet, "/", nil)
+			caddyhttp.SetVar(r.Context(), "tool", test.tool)
+			caddyhttp.SetVar(r.Context(), "arg", "selected")
+			w, err := serveTest(m, r)
+			if test.status != http.StatusOK {
+				var handlerErr caddyhttp.HandlerError
+				if !errors.As(err, &handlerErr) || handlerErr.StatusCode != test.status {
+					t.Errorf("the request is not rejected with %d: %v", test.status, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var resp struct {
+				Stdout string `json:"stdout"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Stdout != "selected\n" {
+				t.Errorf("stdout %q", resp.Stdout)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// replacePipeTo returns the PipeTo command and args with placeholders
+// replaced by repl.
+func (c *Cmd) replacePipeTo(repl *caddy.Replacer) []string {
+	if len(c.PipeTo) == 0 {
+		return nil
+	}
+	pipeTo := make([]string, len(c.PipeTo))
+	for index, argument := range c.PipeTo {
+		pipeTo[index] = repl.ReplaceAll(argument, "")
+	}
+	return pipeTo
+}
+
+// runPiped runs the command with its standard output piped to the
+// standard input of the PipeTo command, whose standard output is written
+// to stdout. Both write their standard error to stderrBuf, the command
+// through stderr. The history records the result of the pipeline once
+// both exited, with the errors of each returned.
+func (c *Cmd) runPiped(ctx context.Context, argv []string, stdin io.Reader, stdout, stderr io.Writer, stdoutBuf, stderrBuf *limitedBuffer) (err, pipeErr error) {
+	pr, pw := io.Pipe()
+
+	cmd, err := c.start(ctx, argv, func() (*exec.Cmd, error) {
+		cmd := c.command(ctx, argv)
+		cmd.Stdin = stdin
+		cmd.Stdout = pw
+		cmd.Stderr = stderr
+		cmd.WaitDelay = outputWaitDelay
+		return cmd, nil
+	})
+	if err != nil {
+		return err, nil
+	}
+
+	// the PipeTo command runs in the slots of the command, with the
+	// same environment.
+	pipeStderr, flushPipeStderr := c.mirrorOutput(stderrBuf, executionID(ctx), "stderr")
+	defer flushPipeStderr()
+	pipeCmd := *c
+	pipeCmd.Command = c.PipeTo[0]
+	pipe, pipeErr := c.startWithRetries(ctx, func() (*exec.Cmd, error) {
+		pipe := pipeCmd.command(ctx, c.PipeTo[1:])
+		pipe.Stdin = pr
+		pipe.Stdout = stdout
+		pipe.Stderr = pipeStderr
+		pipe.WaitDelay = outputWaitDelay
+		return pipe, nil
+	})
+
+	done := make(chan error, 1)
+	if pipeErr != nil {
+		// the command fails writing its output, if it writes any.
+		pr.CloseWithError(io.ErrClosedPipe)
+		done <- pipeErr
+	} else {
+		c.running.add(pipe.Process, nil)
+		go func() {
+			err := pipe.Wait()
+			c.running.remove(pipe.Process)
+			// the command fails writing the output left unread
+			pr.CloseWithError(io.ErrClosedPipe)
+			done <- err
+		}()
+	}
+
+	err = cmd.Wait()
+	// end of input for the PipeTo command
+	pw.Close()
+	pipeErr = <-done
+	if killedBySIGPIPE(err) || errors.Is(err, io.ErrClosedPipe) {
+		// the PipeTo command exited without reading all of the output,
+		// as head does, only its own failure is one.
+		err = nil
+	}
+
+	started := c.running.remove(cmd.Process)
+	code, result := c.exitResult(err, stdoutBuf, stderrBuf)
+	if result == nil && pipeErr == nil {
+		c.cooldown.record()
+	}
+	if result == nil && pipeErr != nil {
+		c.history.record(started, exitCode(pipeErr), fmt.Errorf("pipe_to: %v", pipeErr), stdoutBuf, stderrBuf)
+	} else {
+		c.history.record(started, code, result, stdoutBuf, stderrBuf)
+	}
+	return err, pipeErr
+}
@@ -0,0 +1,58 @@
+package command
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// pool bounds the number of processes running at once across all
+// the commands that share it.
+type pool struct {
+	slots chan struct{}
+}
+
+func newPool(size int) *pool {
+	return &pool{slots: make(chan struct{}, size)}
+}
+
+// acquire blocks until a slot of the pool is available, or ctx is done.
+func (p *pool) acquire(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot taken by acquire.
+func (p *pool) release() {
+	if p != nil {
+		<-p.slots
+	}
+}
+
+// lookupPool returns the pool named name declared in the exec app.
+// Commands of the app use it directly, as the app is not registered
+// to ctx until it is provisioned.
+func lookupPool(ctx caddy.Context, cm caddy.Module, name string) (*pool, error) {
+	app, ok := cm.(*App)
+	if !ok {
+		a, err := ctx.AppIfConfigured("exec")
+		if err != nil {
+			return nil, fmt.Errorf("pool '%s' is not declared: %v", name, err)
+		}
+		app = a.(*App)
+	}
+
+	p, ok := app.pools[name]
+	if !ok {
+		return nil, fmt.Errorf("pool '%s' is not declared", name)
+	}
+	return p, nil
+}
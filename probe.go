@@ -0,0 +1,68 @@
+package command
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultProbeCache is the default duration a probe result is reused.
+const defaultProbeCache = 5 * time.Second
+
+// defaultProbeTimeout is the default duration a probe may run, checks
+// wait for it.
+const defaultProbeTimeout = 2 * time.Second
+
+// prober runs the command as a health check and caches the result.
+type prober struct {
+	expect  *regexp.Regexp // nil to only check the exit code
+	cache   time.Duration
+	timeout time.Duration // instead of the timeout of the command
+
+	mu      sync.Mutex
+	healthy bool
+	expires time.Time
+}
+
+// check returns the health of the command, running it if the cached
+// result has expired. Concurrent checks share the same run.
+func (p *prober) check(ctx context.Context, c *Cmd, argv []string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Now().Before(p.expires) {
+		return p.healthy
+	}
+
+	probe := *c
+	probe.timeout = p.timeout
+	out := probe.collectOutput(ctx, argv, nil)
+	p.healthy = out.err == nil && (p.expect == nil || p.expect.Match(out.stdout))
+	if !p.healthy {
+		c.log.Warn("probe failed", zap.String("command", c.Command), zap.Int("exit_code", out.exitCode), zap.Error(out.err))
+	}
+	p.expires = time.Now().Add(p.cache)
+	return p.healthy
+}
+
+// serveProbe responds with 200 if the command is healthy, 503 otherwise.
+func (m Middleware) serveProbe(w http.ResponseWriter, r *http.Request, argv []string) error {
+	// the result is shared with other requests, it must not depend
+	// on the request that triggered the run.
+	ctx := context.WithoutCancel(r.Context())
+
+	status := http.StatusOK
+	if !m.prober.check(ctx, &m.Cmd, argv) {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	_, err := w.Write([]byte(http.StatusText(status) + "\n"))
+	return err
+}
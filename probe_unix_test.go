@@ -0,0 +1,25 @@
+//go:build unix
+
+package command
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestProbeTimeout(t *testing.T) {
+	m := newTestMiddleware(t, "exec sleep 10 {\n probe\n probe_timeout 200ms\n timeout 1m\n}")
+
+	start := time.Now()
+	w, err := serveTest(m, newTestRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("the probe responded after %s", elapsed)
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d", w.Code)
+	}
+}
@@ -0,0 +1,467 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// processes keeps track of the running processes of a command.
+type processes struct {
+	mu     sync.Mutex
+	procs  map[*os.Process]runningProcess
+	killed bool // processes started from now on are killed
+}
+
+type runningProcess struct {
+	started time.Time
+	release func() // frees the slots held by the process
+}
+
+func newProcesses() *processes {
+	return &processes{procs: map[*os.Process]runningProcess{}}
+}
+
+func (p *processes) add(proc *os.Process, release func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.procs[proc] = runningProcess{started: time.Now(), release: release}
+	if p.killed {
+		_ = signalProcessGroup(proc, os.Kill)
+	}
+}
+
+// remove stops keeping track of proc, releasing its slots, and returns
+// the time it started at.
+func (p *processes) remove(proc *os.Process) time.Time {
+	p.mu.Lock()
+	running := p.procs[proc]
+	delete(p.procs, proc)
+	p.mu.Unlock()
+	if running.release != nil {
+		running.release()
+	}
+	return running.started
+}
+
+// signal sends sig to the process group of each running process.
+func (p *processes) signal(sig os.Signal) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for proc := range p.procs {
+		_ = signalProcessGroup(proc, sig)
+	}
+}
+
+// kill kills the process group of each running process, and of the
+// processes started afterwards. They stop being tracked once waited for.
+func (p *processes) kill() {
+	p.mu.Lock()
+	p.killed = true
+	p.mu.Unlock()
+	p.signal(os.Kill)
+}
+
+// command creates the exec.Cmd to run the command with args.
+// The command is killed when ctx is done.
+func (c *Cmd) command(ctx context.Context, args []string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if c.loginShell != "" {
+		// the shell runs the positional parameters, they are not
+		// interpolated in the script.
+		shellArgs := append([]string{"-lc", `exec "$0" "$@"`, c.Command}, args...)
+		cmd = exec.CommandContext(ctx, c.loginShell, shellArgs...)
+	} else {
+		cmd = exec.CommandContext(ctx, c.Command, args...)
+	}
+	cmd.Dir = c.Directory
+	env := append(cmd.Environ(), c.correlationEnv(ctx)...)
+	cmd.Env = c.unsetEnv(append(env, c.claimsEnv(ctx)...))
+	setProcessGroup(cmd)
+	if c.ReadOnlyRoot && sandboxSupported {
+		if err := sandbox(cmd, c.WritablePaths); err != nil {
+			// reported by Start
+			cmd.Err = err
+		}
+	}
+	return cmd
+}
+
+// correlationEnv returns the environment variables with the execution
+// ID and the traceparent of the request, if any, for the command to
+// forward in its own requests.
+func (c *Cmd) correlationEnv(ctx context.Context) []string {
+	env := []string{c.correlationIDEnv() + "=" + executionID(ctx)}
+
+	if repl, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		if traceparent, ok := repl.GetString("http.request.header.Traceparent"); ok && traceparent != "" {
+			env = append(env, c.traceparentEnv()+"="+traceparent)
+		}
+	}
+	return env
+}
+
+// correlationIDEnv returns the name of the environment variable set to
+// the execution ID.
+func (c *Cmd) correlationIDEnv() string {
+	if c.CorrelationIDEnv == "" {
+		return "EXEC_CORRELATION_ID"
+	}
+	return c.CorrelationIDEnv
+}
+
+// traceparentEnv returns the name of the environment variable set to the
+// traceparent of the request.
+func (c *Cmd) traceparentEnv() string {
+	if c.TraceparentEnv == "" {
+		return "TRACEPARENT"
+	}
+	return c.TraceparentEnv
+}
+
+// claimsEnv returns the environment variables of the claims mapped by
+// ClaimsToEnv of the user authenticated for the request, if any.
+func (c *Cmd) claimsEnv(ctx context.Context) []string {
+	if len(c.ClaimsToEnv) == 0 {
+		return nil
+	}
+	repl, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return nil
+	}
+
+	var env []string
+	for claim, name := range c.ClaimsToEnv {
+		value, ok := repl.GetString("http.auth.user." + claim)
+		// a NUL would fail the start of the command
+		if !ok || strings.ContainsRune(value, 0) {
+			continue
+		}
+		env = append(env, name+"="+value)
+	}
+	return env
+}
+
+// unsetEnv returns env without the variables listed in UnsetEnv.
+func (c *Cmd) unsetEnv(env []string) []string {
+	if len(c.UnsetEnv) == 0 {
+		return env
+	}
+	return slices.DeleteFunc(env, func(kv string) bool {
+		name, _, _ := strings.Cut(kv, "=")
+		for _, unset := range c.UnsetEnv {
+			// names are case-insensitive on Windows
+			if name == unset || runtime.GOOS == "windows" && strings.EqualFold(name, unset) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// start starts the command created by newCmd to run argv and keeps
+// track of its process while it runs. Start failures listed in
+// StartRetryErrors are retried with a new command, as an exec.Cmd can
+// only be started once. The last created command is returned, even if
+// it failed to start.
+//
+// If the command is in a pool or limits identical runs, start waits
+// for a free slot, which is released by wait.
+func (c *Cmd) start(ctx context.Context, argv []string, newCmd func() (*exec.Cmd, error)) (*exec.Cmd, error) {
+	release, err := c.acquire(ctx, argv)
+	if err != nil {
+		return nil, err
+	}
+	cmd, err := c.startWithRetries(ctx, newCmd)
+	if err != nil {
+		release()
+		return cmd, err
+	}
+	c.running.add(cmd.Process, release)
+	return cmd, nil
+}
+
+// acquire takes the lock and slots required to run argv and returns the
+// function releasing them. Waiting for them is abandoned with
+// errAbandoned once the client of the command went away, as nobody
+// waits for its result anymore, or once ctx is done.
+func (c *Cmd) acquire(ctx context.Context, argv []string) (release func(), err error) {
+	if client, ok := ctx.Value(clientCtxKey{}).(context.Context); ok {
+		// ctx outlives the client to let started commands complete
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		defer context.AfterFunc(client, cancel)()
+	}
+
+	unlock := func() {}
+	if c.LockKey != "" {
+		lockKey := c.lockKey(ctx)
+		if err := c.acquireLock(ctx, lockKey); err != nil {
+			return nil, err
+		}
+		unlock = func() { locks.release(lockKey) }
+	}
+
+	var key string
+	if c.identical != nil {
+		key = identicalKey(c.Command, argv)
+		err := c.identical.acquire(ctx, key, c.IdenticalOverflow != "reject")
+		if err == errTooManyIdentical {
+			c.log.Warn("too many identical commands running",
+				zap.String("command", c.Command),
+				zap.Strings("args", argv),
+				zap.Int("max_identical", c.MaxIdentical),
+			)
+		}
+		if err != nil {
+			unlock()
+			return nil, waitError(err)
+		}
+	}
+	if err := c.pool.acquire(ctx); err != nil {
+		if c.identical != nil {
+			c.identical.release(key)
+		}
+		unlock()
+		return nil, waitError(err)
+	}
+	return func() {
+		c.pool.release()
+		if c.identical != nil {
+			c.identical.release(key)
+		}
+		unlock()
+	}, nil
+}
+
+// lockKey returns the LockKey with placeholders replaced by the replacer
+// of the request ctx is bound to, if any.
+func (c *Cmd) lockKey(ctx context.Context) string {
+	repl, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		repl = caddy.NewReplacer()
+	}
+	return repl.ReplaceAll(c.LockKey, "")
+}
+
+// acquireLock takes the lock of key, waiting up to LockTimeout for
+// another run to release it.
+func (c *Cmd) acquireLock(ctx context.Context, key string) error {
+	lockCtx := ctx
+	if c.lockTimeout > 0 {
+		var cancel context.CancelFunc
+		lockCtx, cancel = context.WithTimeout(ctx, c.lockTimeout)
+		defer cancel()
+	}
+	err := locks.acquire(lockCtx, key, true)
+	if err != nil && ctx.Err() == nil {
+		c.log.Warn("lock held by another run",
+			zap.String("command", c.Command),
+			zap.String("lock_key", key),
+			zap.Duration("lock_timeout", c.lockTimeout),
+		)
+		return errLocked
+	}
+	return waitError(err)
+}
+
+// errAbandoned is returned when the client of a command went away while
+// the command was waiting for a free slot.
+var errAbandoned = errors.New("client went away while waiting for a free slot")
+
+// clientCtxKey is the context key of the context of the client a command
+// runs for, when the context of the command is not cancelled with it.
+type clientCtxKey struct{}
+
+// waitError returns the error of waiting for a slot that failed with err.
+func waitError(err error) error {
+	if err == context.Canceled {
+		return errAbandoned
+	}
+	return err
+}
+
+func (c *Cmd) startWithRetries(ctx context.Context, newCmd func() (*exec.Cmd, error)) (*exec.Cmd, error) {
+	backoff := startRetryBackoff
+	for attempt := 0; ; attempt++ {
+		cmd, err := newCmd()
+		if err != nil {
+			return cmd, err
+		}
+		copyStdin, err := pipeStdin(cmd)
+		if err != nil {
+			return cmd, err
+		}
+		err = cmd.Start()
+		if err == nil {
+			copyStdin()
+			return cmd, nil
+		}
+		if attempt >= c.StartRetries || !c.retryableStartError(err) {
+			return cmd, err
+		}
+
+		c.log.Debug("retrying command start",
+			zap.Int("attempt", attempt+1),
+			zap.Duration("backoff", backoff),
+			zap.Error(err),
+		)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return cmd, err
+		}
+		backoff *= 2
+	}
+}
+
+// pipeStdin replaces the standard input of cmd, if it is not a file, with
+// a pipe the returned function starts copying it to once cmd started.
+// Unlike the copy of exec, Wait does not wait for it, so that a blocked
+// read of the input, e.g. of a stalled request body, cannot keep Wait
+// from returning once the command exited or was killed.
+func pipeStdin(cmd *exec.Cmd) (copyStdin func(), err error) {
+	stdin := cmd.Stdin
+	if _, ok := stdin.(*os.File); ok || stdin == nil {
+		return func() {}, nil
+	}
+
+	cmd.Stdin = nil
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		go func() {
+			// errors mean that the command exited, or closed its
+			// standard input before reading all of it.
+			io.Copy(w, stdin)
+			w.Close()
+		}()
+	}, nil
+}
+
+// startRetryBackoff is the delay before the first start retry,
+// doubled for each subsequent retry.
+const startRetryBackoff = 10 * time.Millisecond
+
+// startRetryErrnos are the errors that may be listed in StartRetryErrors.
+var startRetryErrnos = map[string]syscall.Errno{
+	"EAGAIN":  syscall.EAGAIN,
+	"EINTR":   syscall.EINTR,
+	"EMFILE":  syscall.EMFILE,
+	"ENFILE":  syscall.ENFILE,
+	"ENOMEM":  syscall.ENOMEM,
+	"ETXTBSY": syscall.ETXTBSY,
+}
+
+// retryableStartError reports whether the start failure err is one
+// of StartRetryErrors.
+func (c *Cmd) retryableStartError(err error) bool {
+	errnos := c.StartRetryErrors
+	if len(errnos) == 0 {
+		errnos = []string{"EAGAIN"}
+	}
+	for _, name := range errnos {
+		if errors.Is(err, startRetryErrnos[name]) {
+			return true
+		}
+	}
+	return false
+}
+
+// wait waits for cmd to exit, stops keeping track of its process and
+// releases its slots. A successful exit starts the cooldown.
+func (c *Cmd) wait(cmd *exec.Cmd) error {
+	return c.waitOutput(cmd, nil, nil)
+}
+
+// waitOutput is wait for a command whose output is collected in stdout
+// and stderr, which are kept in the history.
+func (c *Cmd) waitOutput(cmd *exec.Cmd, stdout, stderr *limitedBuffer) error {
+	err := cmd.Wait()
+	started := c.running.remove(cmd.Process)
+	code, result := c.exitResult(err, stdout, stderr)
+	if result == nil {
+		c.cooldown.record()
+	}
+	c.history.record(started, code, result, stdout, stderr)
+	return err
+}
+
+// forwarder relays the signals received by Caddy to the commands
+// that opted in.
+var forwarder = &signalForwarder{targets: map[*processes][]os.Signal{}}
+
+type signalForwarder struct {
+	mu      sync.Mutex
+	targets map[*processes][]os.Signal
+	notify  chan os.Signal
+}
+
+// add starts relaying sigs to the processes in p.
+func (f *signalForwarder) add(p *processes, sigs []os.Signal) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.notify == nil {
+		f.notify = make(chan os.Signal, 1)
+		go f.relay(f.notify)
+	}
+	f.targets[p] = sigs
+
+	// Notify only adds a channel, handlers registered by
+	// Caddy keep receiving the signals.
+	signal.Notify(f.notify, sigs...)
+}
+
+// remove stops relaying signals to the processes in p.
+func (f *signalForwarder) remove(p *processes) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.targets[p]; !ok {
+		return
+	}
+	delete(f.targets, p)
+
+	// Stop only affects our channel, unlike signal.Reset which would
+	// also unregister Caddy's handlers.
+	signal.Stop(f.notify)
+	if len(f.targets) == 0 {
+		close(f.notify)
+		f.notify = nil
+		return
+	}
+	for _, sigs := range f.targets {
+		signal.Notify(f.notify, sigs...)
+	}
+}
+
+func (f *signalForwarder) relay(notify chan os.Signal) {
+	for sig := range notify {
+		f.mu.Lock()
+		for p, sigs := range f.targets {
+			for _, s := range sigs {
+				if s == sig {
+					p.signal(sig)
+					break
+				}
+			}
+		}
+		f.mu.Unlock()
+	}
+}
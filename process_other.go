@@ -0,0 +1,21 @@
+//go:build !unix
+
+package command
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func parseSignal(name string) (os.Signal, error) {
+	return nil, fmt.Errorf("signal forwarding is not supported on this platform")
+}
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func signalProcessGroup(proc *os.Process, sig os.Signal) error {
+	return proc.Signal(sig)
+}
+
+func killedBySIGPIPE(err error) bool { return false }
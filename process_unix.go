@@ -0,0 +1,58 @@
+//go:build unix
+
+package command
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// forwardableSignals are the signals that can be forwarded to commands.
+// Signals used by Caddy to shut down are excluded, as well as the ones
+// that cannot be caught.
+var forwardableSignals = map[string]syscall.Signal{
+	"SIGHUP":   syscall.SIGHUP,
+	"SIGUSR1":  syscall.SIGUSR1,
+	"SIGUSR2":  syscall.SIGUSR2,
+	"SIGWINCH": syscall.SIGWINCH,
+}
+
+func parseSignal(name string) (os.Signal, error) {
+	sig, ok := forwardableSignals[name]
+	if !ok {
+		return nil, fmt.Errorf("signal '%s' cannot be forwarded, supported signals are SIGHUP, SIGUSR1, SIGUSR2 and SIGWINCH", name)
+	}
+	return sig, nil
+}
+
+// setProcessGroup makes cmd run in its own process group, so that
+// signals reach the children of the command as well.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return signalProcessGroup(cmd.Process, syscall.SIGKILL)
+	}
+}
+
+func signalProcessGroup(proc *os.Process, sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return proc.Signal(sig)
+	}
+	return syscall.Kill(-proc.Pid, s)
+}
+
+// killedBySIGPIPE reports whether err is the exit of a command killed by
+// SIGPIPE, or of a shell reporting it with the 128+13 exit status.
+func killedBySIGPIPE(err error) bool {
+	exitError, ok := err.(*exec.ExitError)
+	if !ok {
+		return false
+	}
+	if status, ok := exitError.Sys().(syscall.WaitStatus); ok && status.Signaled() && status.Signal() == syscall.SIGPIPE {
+		return true
+	}
+	return exitError.ExitCode() == 128+int(syscall.SIGPIPE)
+}
@@ -0,0 +1,297 @@
+//go:build unix
+
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// waitRunning waits for p to track a single process and returns it.
+func waitRunning(t *testing.T, p *processes) *os.Process {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		p.mu.Lock()
+		for proc := range p.procs {
+			p.mu.Unlock()
+			return proc
+		}
+		p.mu.Unlock()
+	}
+	t.Fatal("the command did not start")
+	return nil
+}
+
+func TestCleanupKillsRunningProcesses(t *testing.T) {
+	for name, test := range map[string]struct {
+		input   string
+		running func(m *Middleware) *processes
+	}{
+		"foreground": {
+			input:   "exec sleep 30 {\n foreground\n}",
+			running: func(m *Middleware) *processes { return m.running },
+		},
+		"background": {
+			input:   "exec sleep 30",
+			running: func(m *Middleware) *processes { return m.running },
+		},
+		"stream": {
+			input:   "exec sleep 30 {\n stream\n}",
+			running: func(m *Middleware) *processes { return m.running },
+		},
+		"steps": {
+			input:   "exec {\n step sleep 30\n}",
+			running: func(m *Middleware) *processes { return m.Steps[0].running },
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			m := newTestMiddleware(t, test.input)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				serveTest(m, newTestRequest(http.MethodGet, "/", nil))
+			}()
+			running := test.running(m)
+			proc := waitRunning(t, running)
+
+			m.Cleanup()
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the request did not complete once the command was killed")
+			}
+			for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+				// the process is reaped once waited for
+				if syscall.Kill(proc.Pid, 0) != nil {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("the process is still running")
+				}
+			}
+			for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+				running.mu.Lock()
+				n := len(running.procs)
+				running.mu.Unlock()
+				if n == 0 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("%d processes are still tracked", n)
+				}
+			}
+		})
+	}
+}
+
+// waitFile waits for the command to write a line to path and returns it.
+func waitFile(t *testing.T, path string) string {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if b, err := os.ReadFile(path); err == nil && strings.HasSuffix(string(b), "\n") {
+			return strings.TrimSuffix(string(b), "\n")
+		}
+	}
+	t.Fatalf("the command did not write %s", path)
+	return ""
+}
+
+func TestCorrelationEnv(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	for _, mode := range []string{"foreground", "background"} {
+		t.Run(mode, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "env")
+			input := `exec sh -c "echo $EXEC_CORRELATION_ID $TRACEPARENT > $0" ` + path
+			if mode == "foreground" {
+				input += " {\n foreground\n}"
+			}
+			m := newTestMiddleware(t, input)
+
+			r := newTestRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Traceparent", traceparent)
+			if _, err := serveTest(m, r); err != nil {
+				t.Fatal(err)
+			}
+
+			repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+			uuid, _ := repl.GetString("http.request.uuid")
+			if got, want := waitFile(t, path), uuid+" "+traceparent; got != want {
+				t.Errorf("environment is %q, expected %q", got, want)
+			}
+		})
+	}
+}
+
+func TestClaimsEnv(t *testing.T) {
+	for _, mode := range []string{"foreground", "background"} {
+		t.Run(mode, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "env")
+			input := "exec sh -c \"echo $USER_ID $USER_ROLE > $0\" " + path + " {\n claim_env id USER_ID\n claim_env role USER_ROLE\n"
+			if mode == "foreground" {
+				input += " foreground\n"
+			}
+			m := newTestMiddleware(t, input+"}")
+
+			r := newTestRequest(http.MethodGet, "/", nil)
+			repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+			repl.Set("http.auth.user.id", "alice")
+			repl.Set("http.auth.user.role", "admin")
+			if _, err := serveTest(m, r); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := waitFile(t, path); got != "alice admin" {
+				t.Errorf("environment is %q, expected the claims", got)
+			}
+		})
+	}
+}
+
+func TestAbandonWaitingCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "runs")
+	m := newTestMiddleware(t, `exec sh -c "echo run >> $0; sleep 1" `+path+" {\n foreground\n max_identical 1\n}")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := serveTest(m, newTestRequest(http.MethodGet, "/", nil))
+		done <- err
+	}()
+	waitFile(t, path)
+
+	// the second request waits for the first command to complete
+	r := newTestRequest(http.MethodGet, "/", nil)
+	ctx, cancel := context.WithCancel(r.Context())
+	abandoned := make(chan error, 1)
+	go func() {
+		_, err := serveTest(m, r.WithContext(ctx))
+		abandoned <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-abandoned:
+		var handlerErr caddyhttp.HandlerError
+		if !errors.As(err, &handlerErr) || handlerErr.StatusCode != statusClientClosedRequest {
+			t.Errorf("the abandoned request is not responded with 499: %v", err)
+		}
+	case <-done:
+		t.Fatal("the abandoned request still waits for a slot")
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if runs := waitFile(t, path); runs != "run" {
+		t.Errorf("the command of the abandoned request ran: %q", runs)
+	}
+}
+
+func TestRequestBodyStdin(t *testing.T) {
+	large := strings.Repeat("a", 200000)
+	for name, test := range map[string]struct {
+		command string
+		body    string
+		stdout  string
+	}{
+		"empty":             {command: "cat", body: "", stdout: ""},
+		"larger than pipes": {command: "wc -c", body: large, stdout: "200000"},
+		"unread":            {command: "true", body: large, stdout: ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			m := newTestMiddleware(t, "exec "+test.command+" {\n foreground\n timeout 5s\n}")
+
+			w, err := serveTest(m, newTestRequest(http.MethodPost, "/", strings.NewReader(test.body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resp struct {
+				Stdout   string `json:"stdout"`
+				ExitCode int    `json:"exit_code"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != http.StatusOK || resp.ExitCode != 0 {
+				t.Errorf("status %d, exit code %d", w.Code, resp.ExitCode)
+			}
+			if stdout := strings.TrimSpace(resp.Stdout); stdout != test.stdout {
+				t.Errorf("stdout %q", stdout)
+			}
+		})
+	}
+}
+
+func TestRequestBodyStdinStream(t *testing.T) {
+	m := newTestMiddleware(t, "exec cat {\n stream\n timeout 5s\n}")
+
+	w, err := serveTest(m, newTestRequest(http.MethodPost, "/", strings.NewReader("first\nsecond\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := w.Body.String()
+	first := strings.Index(body, "event: stdout\ndata: first\n")
+	second := strings.Index(body, "event: stdout\ndata: second\n")
+	if first < 0 || second < first || !strings.Contains(body, "event: close") {
+		t.Errorf("the request body is not streamed back:\n%s", body)
+	}
+}
+
+// copyingStdin reports whether a goroutine is still copying a request
+// body to the standard input of a command.
+func copyingStdin() bool {
+	buf := make([]byte, 1<<20)
+	return strings.Contains(string(buf[:runtime.Stack(buf, true)]), "pipeStdin")
+}
+
+func TestStalledRequestBodyTimeout(t *testing.T) {
+	m := newTestMiddleware(t, "exec cat {\n foreground\n timeout 300ms\n}")
+
+	// a client that sent part of the body and then stalled
+	body, client := io.Pipe()
+	go client.Write([]byte("partial\n"))
+	start := time.Now()
+	w, err := serveTest(m, newTestRequest(http.MethodPost, "/", body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("responded after %s", elapsed)
+	}
+	var resp struct {
+		Stdout   string `json:"stdout"`
+		TimedOut bool   `json:"timed_out"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.TimedOut || resp.Stdout != "partial\n" {
+		t.Errorf("timed out %v, stdout %q", resp.TimedOut, resp.Stdout)
+	}
+
+	if !copyingStdin() {
+		t.Fatal("the stalled request body is not being copied")
+	}
+	// the server closes the body once the handler returned
+	body.Close()
+	for deadline := time.Now().Add(5 * time.Second); copyingStdin(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the request body is still copied to the command")
+		}
+	}
+}
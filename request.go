@@ -0,0 +1,122 @@
+package command
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"unicode/utf8"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// defaultRequestBodyLimit is the default maximum size of the body
+// serialized with RequestToStdin or written with BodyToTempFile.
+const defaultRequestBodyLimit = 1 << 20
+
+// defaultExcludedHeaders are the headers excluded from the request
+// serialized with RequestToStdin, if none are configured.
+var defaultExcludedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// stdinRequest is the JSON representation of a request written to the
+// standard input of the command with RequestToStdin.
+type stdinRequest struct {
+	Method     string      `json:"method"`
+	Host       string      `json:"host"`
+	Path       string      `json:"path"`
+	Query      url.Values  `json:"query"`
+	Headers    http.Header `json:"headers"`
+	RemoteAddr string      `json:"remote_addr"`
+	Body       string      `json:"body,omitempty"`
+	BodyBase64 string      `json:"body_base64,omitempty"`
+}
+
+// requestStdin returns the standard input of the command for the request.
+func (m Middleware) requestStdin(r *http.Request) (io.Reader, error) {
+	if !m.RequestToStdin {
+		return r.Body, nil
+	}
+
+	limit := m.requestBodyLimit()
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("reading request body: %v", err))
+	}
+	if int64(len(body)) > limit {
+		return nil, caddyhttp.Error(http.StatusRequestEntityTooLarge, fmt.Errorf("request body larger than %d bytes", limit))
+	}
+
+	excluded := m.RequestExcludeHeaders
+	if excluded == nil {
+		excluded = defaultExcludedHeaders
+	}
+	headers := r.Header.Clone()
+	for _, name := range excluded {
+		headers.Del(name)
+	}
+
+	req := stdinRequest{
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		Query:      r.URL.Query(),
+		Headers:    headers,
+		RemoteAddr: r.RemoteAddr,
+	}
+	if utf8.Valid(body) {
+		req.Body = string(body)
+	} else {
+		req.BodyBase64 = base64.StdEncoding.EncodeToString(body)
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
+
+func (c *Cmd) requestBodyLimit() int64 {
+	if c.RequestBodyLimit == 0 {
+		return defaultRequestBodyLimit
+	}
+	return c.RequestBodyLimit
+}
+
+// writeBodyFile writes the body of the request to a temporary file and
+// sets its path to the {http.exec.bodyfile} placeholder. The returned
+// function removes the file.
+func (m Middleware) writeBodyFile(r *http.Request, repl *caddy.Replacer) (remove func(), err error) {
+	f, err := os.CreateTemp(m.TempDir, "caddy-exec-body-*")
+	if err != nil {
+		return nil, caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("creating body file: %v", err))
+	}
+	remove = func() {
+		if err := os.Remove(f.Name()); err != nil {
+			m.log.Error("removing body file", zap.Error(err))
+		}
+	}
+
+	limit := m.requestBodyLimit()
+	n, err := io.Copy(f, io.LimitReader(r.Body, limit+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		remove()
+		return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("writing body file: %v", err))
+	}
+	if n > limit {
+		remove()
+		return nil, caddyhttp.Error(http.StatusRequestEntityTooLarge, fmt.Errorf("request body larger than %d bytes", limit))
+	}
+
+	repl.Set("http.exec.bodyfile", f.Name())
+	return remove, nil
+}
@@ -3,10 +3,13 @@ package command
 import (
 	"context"
 	"io"
+	"math/rand/v2"
 	"os/exec"
 	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 // Runner runs a command.
@@ -18,49 +21,85 @@ type runnerFunc func() error
 
 func (r runnerFunc) Run() error { return r() }
 
-func (c *Cmd) run(args []string) error {
-	return c.runWithInput(args, nil)
+// run runs the command with args. The command is not cancelled with ctx,
+// which binds it to the request it runs for, if any.
+func (c *Cmd) run(ctx context.Context, args []string) error {
+	if c.StdinFile == "" {
+		return c.runWithInput(ctx, args, nil)
+	}
+
+	repl, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		repl = caddy.NewReplacer()
+	}
+	f, err := c.openStdinFile(repl)
+	if err != nil {
+		c.log.Error("opening stdin file", zap.Error(err))
+		return err
+	}
+	// the command has its own descriptor once started.
+	defer f.Close()
+	return c.runWithInput(ctx, args, f)
 }
 
-func (c *Cmd) runWithInput(args []string, stdin io.Reader) error {
+// logSampled reports whether the exit of a successful execution is
+// logged with LogSample. All executions are logged at debug level.
+func (c *Cmd) logSampled() bool {
+	if c.LogSample <= 1 || c.log.Core().Enabled(zapcore.DebugLevel) {
+		return true
+	}
+	return rand.IntN(c.LogSample) == 0
+}
+
+func (c *Cmd) runWithInput(ctx context.Context, args []string, stdin io.Reader) error {
 	cmdInfo := zap.Any("command", append([]string{c.Command}, args...))
 	log := c.log.With(cmdInfo)
 	startTime := time.Now()
 
-	cmd := exec.Command(c.Command, args...)
-
+	// the command outlives the request it may run for, whose values are
+	// still needed to start it, e.g. for its environment.
+	ctx = context.WithoutCancel(ctx)
 	done := make(chan struct{}, 1)
 
 	// timeout
 	if c.timeout > 0 {
-		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
 
 		// the context must not be cancelled before the command is done
 		go func() {
 			<-done
 			cancel()
 		}()
-
-		cmd = exec.CommandContext(ctx, c.Command, args...)
 	}
 
 	// configure command
-	{
-		cmd.Stdout = c.stdWriter
-		cmd.Stderr = c.stdWriter
-		if c.errWriter != nil {
-			cmd.Stderr = c.errWriter
-		}
+	id := executionID(ctx)
+	errWriter := c.stdWriter
+	if c.errWriter != nil {
+		errWriter = c.errWriter
+	}
+	stdoutWriter, flushStdout := c.mirrorOutput(c.stdWriter, id, "stdout")
+	stderrWriter, flushStderr := c.mirrorOutput(errWriter, id, "stderr")
+	newCmd := func() (*exec.Cmd, error) {
+		cmd := c.command(ctx, args)
+		cmd.Stdout = stdoutWriter
+		cmd.Stderr = stderrWriter
 		cmd.Stdin = stdin
-		cmd.Dir = c.Directory
+		return cmd, nil
 	}
 
+	// start command
+	cmd, err := c.start(ctx, args, newCmd)
+
 	wait := func(err error) error {
 		// only wait if start was successful
-		if cmd.Process != nil {
+		if cmd != nil && cmd.Process != nil {
 			// err is empty, we can reuse it without losing any info
-			err = cmd.Wait()
+			err = c.wait(cmd)
 		}
+		flushStdout()
+		flushStderr()
 		done <- struct{}{}
 
 		log = log.With(zap.Duration("duration", time.Since(startTime))).Named("exit")
@@ -70,13 +109,12 @@ func (c *Cmd) runWithInput(args []string, stdin io.Reader) error {
 			return err
 		}
 
-		log.Info("")
+		if c.logSampled() {
+			log.Info("")
+		}
 		return nil
 	}
 
-	// start command
-	err := cmd.Start()
-
 	if c.Foreground {
 		return wait(err)
 	}
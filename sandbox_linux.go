@@ -0,0 +1,200 @@
+//go:build linux
+
+package command
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// sandboxEnv is set in the environment of the Caddy binary re-executed
+// to set up the mount namespace of a read-only root command.
+const sandboxEnv = "CADDY_EXEC_SANDBOX"
+
+// sandboxSupported is true if read-only root is supported on this platform.
+const sandboxSupported = true
+
+type sandboxConfig struct {
+	Writable []string `json:"writable,omitempty"`
+}
+
+func init() {
+	if config, ok := os.LookupEnv(sandboxEnv); ok {
+		runSandboxed(config)
+	}
+}
+
+// sandbox makes cmd run in a new mount namespace, where the filesystem
+// is read-only except for the writable paths. Caddy's binary is re-executed
+// in the namespace to remount the filesystem before running the command.
+func sandbox(cmd *exec.Cmd, writable []string) error {
+	config, err := json.Marshal(sandboxConfig{Writable: writable})
+	if err != nil {
+		return err
+	}
+
+	cmd.Env = append(cmd.Environ(), sandboxEnv+"="+string(config))
+	cmd.Path = "/proc/self/exe"
+	// the command is looked up within the namespace.
+	cmd.Err = nil
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNS
+	return nil
+}
+
+// runSandboxed sets up the mount namespace and replaces the re-executed
+// Caddy process with the command. It never returns.
+func runSandboxed(config string) {
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "exec: read-only root: %v\n", err)
+		os.Exit(126)
+	}
+
+	var sc sandboxConfig
+	if err := json.Unmarshal([]byte(config), &sc); err != nil {
+		fail(err)
+	}
+	if err := remountReadOnly(sc.Writable); err != nil {
+		fail(err)
+	}
+
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil && !errors.Is(err, exec.ErrDot) {
+		fail(err)
+	}
+
+	env := make([]string, 0, len(os.Environ()))
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, sandboxEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	fail(syscall.Exec(path, os.Args, env))
+}
+
+// remountReadOnly remounts every mount of the namespace read-only, except
+// for the writable paths and the /dev, /proc and /sys pseudo filesystems.
+func remountReadOnly(writable []string) error {
+	// keep the changes from propagating to the host.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %v", err)
+	}
+
+	mounts, err := mountPoints()
+	if err != nil {
+		return err
+	}
+
+	// writable paths become mounts of their own, unaffected by the remount.
+	isWritable := map[string]bool{}
+	for _, path := range writable {
+		if err := syscall.Mount(path, path, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("mounting writable path '%s': %v", path, err)
+		}
+		isWritable[path] = true
+	}
+
+	for _, mount := range mounts {
+		if isWritable[mount.path] || isPseudoFilesystem(mount.path) {
+			continue
+		}
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+		if err := syscall.Mount("", mount.path, "", flags|mount.flags, ""); err != nil {
+			return fmt.Errorf("remounting '%s' read-only: %v", mount.path, err)
+		}
+	}
+
+	return nil
+}
+
+func isPseudoFilesystem(path string) bool {
+	for _, dir := range []string{"/dev", "/proc", "/sys"} {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+type mountPoint struct {
+	path  string
+	flags uintptr // per-mount flags to preserve when remounting
+}
+
+// mountPoints returns the mounts of the namespace from /proc/self/mountinfo.
+func mountPoints() ([]mountPoint, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []mountPoint
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+
+		path, err := unescapeMountPath(fields[4])
+		if err != nil {
+			return nil, err
+		}
+
+		var flags uintptr
+		for _, option := range strings.Split(fields[5], ",") {
+			switch option {
+			case "nosuid":
+				flags |= syscall.MS_NOSUID
+			case "nodev":
+				flags |= syscall.MS_NODEV
+			case "noexec":
+				flags |= syscall.MS_NOEXEC
+			case "noatime":
+				flags |= syscall.MS_NOATIME
+			case "nodiratime":
+				flags |= syscall.MS_NODIRATIME
+			case "relatime":
+				flags |= syscall.MS_RELATIME
+			}
+		}
+
+		mounts = append(mounts, mountPoint{path: path, flags: flags})
+	}
+
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPath decodes the octal escapes of a mountinfo path, e.g. \040 for a space.
+func unescapeMountPath(path string) (string, error) {
+	if !strings.Contains(path, `\`) {
+		return path, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			c, err := strconv.ParseUint(path[i+1:i+4], 8, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid mount path '%s': %v", path, err)
+			}
+			b.WriteByte(byte(c))
+			i += 3
+			continue
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String(), nil
+}
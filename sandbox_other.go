@@ -0,0 +1,10 @@
+//go:build !linux
+
+package command
+
+import "os/exec"
+
+// sandboxSupported is true if read-only root is supported on this platform.
+const sandboxSupported = false
+
+func sandbox(cmd *exec.Cmd, writable []string) error { return nil }
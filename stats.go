@@ -0,0 +1,73 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamStats counts the output of a streamed command and periodically
+// sends it as a "stats" event with StatsInterval.
+type streamStats struct {
+	lines atomic.Int64
+	bytes atomic.Int64
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// startStats sends the stats of the stream written to w every
+// StatsInterval until stop is called or ctx is done. The events are
+// written with mu held, and their names prefixed with prefix.
+func (c *Cmd) startStats(ctx context.Context, w io.Writer, flusher http.Flusher, mu *sync.Mutex, prefix string) *streamStats {
+	s := &streamStats{quit: make(chan struct{}), done: make(chan struct{})}
+	startTime := time.Now()
+	ticker := time.NewTicker(c.statsInterval)
+
+	go func() {
+		defer close(s.done)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.quit:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			data, _ := json.Marshal(struct {
+				Lines     int64 `json:"lines"`
+				Bytes     int64 `json:"bytes"`
+				ElapsedMs int64 `json:"elapsed_ms"`
+			}{s.lines.Load(), s.bytes.Load(), time.Since(startTime).Milliseconds()})
+			mu.Lock()
+			writeEvent(w, prefix+"stats", string(data))
+			flusher.Flush()
+			mu.Unlock()
+		}
+	}()
+	return s
+}
+
+// line counts a line of size bytes, without its line ending.
+func (s *streamStats) line(size int) {
+	if s == nil {
+		return
+	}
+	s.lines.Add(1)
+	s.bytes.Add(int64(size) + 1)
+}
+
+// stop stops sending stats, no event is written once it returns.
+func (s *streamStats) stop() {
+	if s == nil {
+		return
+	}
+	close(s.quit)
+	<-s.done
+}
@@ -0,0 +1,63 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// openStdinFile opens StdinFile, after replacing placeholders with repl.
+// The file must be within StdinFileRoot, symbolic links included.
+func (c *Cmd) openStdinFile(repl *caddy.Replacer) (*os.File, error) {
+	root := c.StdinFileRoot
+	if root == "" {
+		root = c.Directory
+	}
+	if root == "" {
+		root = "."
+	}
+
+	name := repl.ReplaceAll(c.StdinFile, "")
+	if filepath.IsAbs(name) {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+		// escapes from the root are rejected by OpenInRoot.
+		name, err = filepath.Rel(absRoot, name)
+		if err != nil {
+			return nil, fmt.Errorf("stdin_file '%s' is not within '%s'", c.StdinFile, root)
+		}
+	}
+
+	f, err := os.OpenInRoot(root, name)
+	if err != nil {
+		return nil, fmt.Errorf("opening stdin_file: %w", err)
+	}
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		f.Close()
+		return nil, fmt.Errorf("stdin_file '%s' is not a file", name)
+	}
+	return f, nil
+}
+
+// requestStdinFile opens StdinFile for a request. Files that do not
+// exist are responded with 404, other failures with 403.
+func (m Middleware) requestStdinFile(repl *caddy.Replacer) (*os.File, error) {
+	f, err := m.openStdinFile(repl)
+	if err != nil {
+		m.log.Error("opening stdin file", zap.Error(err))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, caddyhttp.Error(http.StatusNotFound, err)
+		}
+		return nil, caddyhttp.Error(http.StatusForbidden, err)
+	}
+	return f, nil
+}
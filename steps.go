@@ -0,0 +1,143 @@
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// stepResult is the result of a step in the JSON response.
+type stepResult struct {
+	Command  string `json:"command"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	ExitCode int    `json:"exit_code"`
+}
+
+// runSteps runs the steps in order and responds with the result of each
+// step. The sequence is aborted at the first failed step unless
+// ContinueOnError is set.
+func (m Middleware) runSteps(w http.ResponseWriter, r *http.Request, stdin io.Reader, next caddyhttp.Handler) error {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	var resp struct {
+		Status string       `json:"status"`
+		Error  string       `json:"error,omitempty"`
+		Steps  []stepResult `json:"steps"`
+	}
+	resp.Status = "success"
+
+	ctx := m.runContext(r)
+	for i := range m.Steps {
+		step := m.Steps[i]
+		step.Command = step.replaceCommand(repl)
+		out := step.collectOutput(ctx, step.replaceArgs(repl), stepStdin(i, stdin))
+
+		result := stepResult{
+			Command:  step.Command,
+			Status:   "success",
+			Stdout:   string(out.stdout),
+			Stderr:   string(out.stderr),
+			ExitCode: out.exitCode,
+		}
+		if out.err != nil {
+			m.log.Error("step finished with error", zap.Int("step", i), zap.String("command", step.Command), zap.Error(out.err))
+			result.Status = "error"
+			result.Error = out.err.Error()
+			resp.Status = "error"
+			resp.Error = fmt.Sprintf("step %d: %v", i, out.err)
+		}
+		resp.Steps = append(resp.Steps, result)
+		setStepPlaceholders(repl, i, out.stdout, out.exitCode)
+
+		if out.err != nil && !m.ContinueOnError {
+			break
+		}
+	}
+
+	if resp.Status == "success" {
+		m.cooldown.record()
+	}
+
+	if m.PassThru {
+		return next.ServeHTTP(w, r)
+	}
+
+	status := m.successStatus()
+	if resp.Status != "success" {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// streamSteps runs the steps in order and streams their output as
+// Server-Sent Events prefixed with the index of the step, e.g. "0.stdout".
+func (m Middleware) streamSteps(w http.ResponseWriter, flusher http.Flusher, r *http.Request, stdin io.Reader) {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	failed := false
+	for i := range m.Steps {
+		step := m.Steps[i]
+		step.Command = step.replaceCommand(repl)
+		prefix := fmt.Sprintf("%d.", i)
+
+		var stdout bytes.Buffer
+		wait, err := step.startStream(r.Context(), w, flusher, step.replaceArgs(repl), stepStdin(i, stdin), prefix, &stdout, nil)
+		if err == nil {
+			err = wait()
+		}
+		setStepPlaceholders(repl, i, stdout.Bytes(), exitCode(err))
+
+		if err != nil {
+			m.log.Error("step finished with error", zap.Int("step", i), zap.String("command", step.Command), zap.Error(err))
+			fmt.Fprintf(w, "event: %serror\ndata: %s\n\n", prefix, err.Error())
+			flusher.Flush()
+			failed = true
+			if !m.ContinueOnError {
+				break
+			}
+		}
+
+		if r.Context().Err() != nil {
+			// client is gone, no need to run the remaining steps.
+			return
+		}
+	}
+	if !failed {
+		m.cooldown.record()
+	}
+
+	fmt.Fprintf(w, "event: close\ndata: Command finished\n\n")
+	flusher.Flush()
+}
+
+// setStepPlaceholders makes the output and the exit code of the step at
+// index i available to the args of the subsequent steps. Trailing newlines
+// are trimmed from the output, so that it can be used as an argument.
+func setStepPlaceholders(repl *caddy.Replacer, i int, stdout []byte, code int) {
+	prefix := fmt.Sprintf("http.exec.step.%d.", i)
+	repl.Set(prefix+"stdout", strings.TrimRight(string(stdout), "\r\n"))
+	repl.Set(prefix+"exit_code", strconv.Itoa(code))
+}
+
+// stepStdin returns the standard input of the step at index i.
+// The standard input of the request can only be read once, it is
+// forwarded to the first step.
+func stepStdin(i int, stdin io.Reader) io.Reader {
+	if i == 0 {
+		return stdin
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package command
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestStepExitCodePlaceholder(t *testing.T) {
+	m := newTestMiddleware(t, "exec {\n step sh -c \"exit 1\" {\n exit_semantics grep\n }\n step echo {http.exec.step.0.exit_code}\n}")
+
+	w, err := serveTest(m, newTestRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		Status string `json:"status"`
+		Steps  []struct {
+			Stdout   string `json:"stdout"`
+			ExitCode int    `json:"exit_code"`
+		} `json:"steps"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "success" || len(resp.Steps) != 2 {
+		t.Fatalf("response %s", w.Body)
+	}
+	if resp.Steps[0].ExitCode != 1 {
+		t.Errorf("the exit code of the first step is %d", resp.Steps[0].ExitCode)
+	}
+	if resp.Steps[1].Stdout != "1\n" {
+		t.Errorf("the exit code placeholder is replaced with %q", resp.Steps[1].Stdout)
+	}
+}
@@ -0,0 +1,157 @@
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// promotingStream collects the output of a command, until it is
+// promoted to a stream of Server-Sent Events.
+type promotingStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	c       *Cmd
+
+	mu       sync.Mutex
+	lines    []bufferedLine // replayed on promotion
+	promoted bool
+}
+
+type bufferedLine struct {
+	event, line string
+}
+
+// line sends the line of the stream event, or buffers it until the
+// stream is promoted.
+func (p *promotingStream) line(event, line string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.promoted {
+		p.lines = append(p.lines, bufferedLine{event, line})
+		return
+	}
+	writeEvent(p.w, event, p.c.formatLine(event, line))
+	p.flusher.Flush()
+}
+
+// promote sends the headers of the event stream and the lines
+// collected so far.
+func (p *promotingStream) promote() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.promoted {
+		return
+	}
+	p.promoted = true
+
+	p.w.Header().Set("Content-Type", "text/event-stream")
+	p.w.Header().Set("Cache-Control", "no-cache")
+	p.w.Header().Set("Connection", "keep-alive")
+	p.w.WriteHeader(http.StatusOK)
+	for _, l := range p.lines {
+		writeEvent(p.w, l.event, p.c.formatLine(l.event, l.line))
+	}
+	p.lines = nil
+	p.flusher.Flush()
+}
+
+// runAndStreamAfter runs the command and responds with its JSON result
+// if it completes within StreamAfter. Otherwise, the response switches
+// to streaming its output, starting with the lines collected so far.
+func (m Middleware) runAndStreamAfter(w http.ResponseWriter, r *http.Request, argv []string, stdin io.Reader) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		m.log.Error("streaming unsupported")
+		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		return nil
+	}
+
+	ctx := m.runContext(r)
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr io.ReadCloser
+	cmd, err := m.start(ctx, argv, func() (*exec.Cmd, error) {
+		cmd := m.command(ctx, argv)
+		cmd.Stdin = stdin
+
+		var err error
+		stdout, err = cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		stderr, err = cmd.StderrPipe()
+		if err != nil {
+			return nil, err
+		}
+		return cmd, nil
+	})
+	if err != nil {
+		m.log.Error("starting command", zap.String("command", m.Command), zap.Strings("args", argv), zap.Error(err))
+		return handlerError(err)
+	}
+
+	stream := &promotingStream{w: w, flusher: flusher, c: &m.Cmd}
+	timer := time.AfterFunc(m.streamAfter, stream.promote)
+
+	// the raw output is kept for the JSON result.
+	var stdoutBuf, stderrBuf bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	id := executionID(ctx)
+	scan := func(r io.Reader, event string, raw *bytes.Buffer) {
+		defer wg.Done()
+		mirror, flushMirror := m.mirrorOutput(nil, id, event)
+		defer flushMirror()
+
+		scanner := bufio.NewScanner(m.decodeReader(io.TeeReader(r, raw)))
+		for scanner.Scan() {
+			stream.line(event, scanner.Text())
+			if mirror != nil {
+				fmt.Fprintln(mirror, scanner.Text())
+			}
+		}
+		m.drain(r, event, scanner.Err())
+	}
+	go scan(stdout, "stdout", &stdoutBuf)
+	go scan(stderr, "stderr", &stderrBuf)
+
+	wg.Wait()
+	err = m.wait(cmd)
+	timer.Stop()
+	code, err := m.exitResult(err, nil, nil)
+	if err != nil {
+		m.log.Error("command finished with error", zap.Error(err))
+	}
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if stream.promoted {
+		m.writeFinalEvents(w, flusher, err)
+		return nil
+	}
+	// keep late timers from promoting the response.
+	stream.promoted = true
+
+	return m.writeOutput(w, output{
+		stdout:      m.decodeBytes(stdoutBuf.Bytes()),
+		stderr:      m.decodeBytes(stderrBuf.Bytes()),
+		err:         err,
+		exitCode:    code,
+		stdoutBytes: int64(stdoutBuf.Len()),
+		stderrBytes: int64(stderrBuf.Len()),
+	}, true)
+}
@@ -0,0 +1,251 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// syslogConns are the syslog connections shared by all commands, by address.
+var syslogConns = struct {
+	sync.Mutex
+	conns map[string]*syslogConn
+}{conns: map[string]*syslogConn{}}
+
+// syslogConn is a connection to a syslog server, dialed lazily and
+// redialed after a failure. Messages are sent in the background, so that
+// a slow or unreachable server does not slow down the commands.
+type syslogConn struct {
+	network string
+	addr    string
+	queue   chan []byte
+
+	mu  sync.Mutex
+	err error // of the last message sent, if it failed
+}
+
+// syslogQueueSize is the number of messages queued for a syslog server,
+// further messages are dropped until it catches up.
+const syslogQueueSize = 1024
+
+// syslogRetryDelay is how long messages are dropped after a failure to
+// reach a syslog server, before it is dialed again.
+const syslogRetryDelay = 5 * time.Second
+
+// errSyslogQueueFull is returned for the messages dropped as the syslog
+// server does not keep up.
+var errSyslogQueueFull = errors.New("syslog queue full, messages are dropped")
+
+// getSyslogConn returns the shared connection to the syslog server at
+// address, e.g. "udp://localhost:514" or "tcp://localhost:601".
+// The network defaults to udp.
+func getSyslogConn(address string) (*syslogConn, error) {
+	network, addr, found := strings.Cut(address, "://")
+	if !found {
+		network, addr = "udp", address
+	}
+	switch network {
+	case "udp", "tcp":
+	default:
+		return nil, fmt.Errorf("unsupported syslog network '%s'", network)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid syslog address '%s': %v", address, err)
+	}
+
+	syslogConns.Lock()
+	defer syslogConns.Unlock()
+
+	key := network + "://" + addr
+	if c, ok := syslogConns.conns[key]; ok {
+		return c, nil
+	}
+	c := &syslogConn{network: network, addr: addr, queue: make(chan []byte, syslogQueueSize)}
+	go c.run()
+	syslogConns.conns[key] = c
+	return c, nil
+}
+
+// send queues msg, without waiting for the server. It returns an error if
+// msg is dropped, or if the last message failed to be sent.
+func (s *syslogConn) send(msg []byte) error {
+	select {
+	case s.queue <- msg:
+	default:
+		return errSyslogQueueFull
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// run sends the queued messages to the server.
+func (s *syslogConn) run() {
+	var conn net.Conn
+	var retry time.Time
+	for msg := range s.queue {
+		if conn == nil {
+			if time.Now().Before(retry) {
+				// dropped while the server is unreachable
+				continue
+			}
+			var err error
+			conn, err = net.DialTimeout(s.network, s.addr, 5*time.Second)
+			if err != nil {
+				s.setErr(err)
+				retry = time.Now().Add(syslogRetryDelay)
+				continue
+			}
+		}
+
+		if s.network == "tcp" {
+			// octet counting framing, RFC 6587
+			msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(msg); err != nil {
+			conn.Close()
+			conn = nil
+			s.setErr(err)
+			retry = time.Now().Add(syslogRetryDelay)
+			continue
+		}
+		s.setErr(nil)
+	}
+}
+
+func (s *syslogConn) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// syslogTimeFormat is RFC 3339 with the microsecond precision of RFC 5424.
+const syslogTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+var hostname = func() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "-"
+	}
+	return name
+}()
+
+// syslogWriter mirrors each line of output of an execution to syslog,
+// as RFC 5424 messages tagged with the command and the execution ID.
+type syslogWriter struct {
+	conn     *syslogConn
+	tag      string
+	command  string
+	id       string
+	stream   string
+	severity int
+	log      *zap.Logger
+
+	mu     sync.Mutex
+	buf    []byte
+	failed bool
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.send(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	// syslog failures must not affect the command.
+	return len(p), nil
+}
+
+// flush sends the last line of output, if not terminated by a newline.
+func (w *syslogWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) > 0 {
+		w.send(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *syslogWriter) send(line []byte) {
+	// facility user
+	pri := 1*8 + w.severity
+	msg := fmt.Sprintf("<%d>1 %s %s %s - %s [exec@32473 command=\"%s\" id=\"%s\"] %s",
+		pri, time.Now().Format(syslogTimeFormat), hostname, w.tag, w.stream,
+		escapeSDParam(w.command), escapeSDParam(w.id), bytes.TrimSuffix(line, []byte("\r")))
+
+	if err := w.conn.send([]byte(msg)); err != nil && !w.failed {
+		// only report the first failure of the execution
+		w.failed = true
+		w.log.Warn("mirroring output to syslog", zap.String("address", w.conn.addr), zap.Error(err))
+	}
+}
+
+// escapeSDParam escapes a structured data parameter value, RFC 5424 section 6.3.3.
+func escapeSDParam(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
+
+// mirrorToSyslog returns w with the output also mirrored to syslog if
+// enabled, and a function sending the last line of output to call once
+// the command has exited.
+func (c *Cmd) mirrorToSyslog(w io.Writer, id, stream string) (io.Writer, func()) {
+	if c.syslog == nil {
+		return w, func() {}
+	}
+
+	tag := c.SyslogTag
+	if tag == "" {
+		tag = "caddy-exec"
+	}
+	severity := 6 // informational
+	if stream == "stderr" {
+		severity = 3 // error
+	}
+
+	sw := &syslogWriter{
+		conn:     c.syslog,
+		tag:      tag,
+		command:  c.Command,
+		id:       id,
+		stream:   stream,
+		severity: severity,
+		log:      c.log,
+	}
+	if w == nil {
+		return sw, sw.flush
+	}
+	return io.MultiWriter(w, sw), sw.flush
+}
+
+// executionID returns the ID of the request if ctx is bound to one,
+// or a new ID otherwise.
+func executionID(ctx context.Context) string {
+	if repl, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		if id, ok := repl.GetString("http.request.uuid"); ok && id != "" {
+			return id
+		}
+	}
+	return uuid.NewString()
+}
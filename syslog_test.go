@@ -0,0 +1,75 @@
+package command
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestSyslogWriterDoesNotWaitForServer(t *testing.T) {
+	// a server that does not keep up, as nothing sends the queue
+	conn := &syslogConn{network: "tcp", addr: "localhost:601", queue: make(chan []byte, 1)}
+	w := &syslogWriter{conn: conn, tag: "test", stream: "stdout", severity: 6, log: zap.NewNop()}
+
+	start := time.Now()
+	for range 1000 {
+		if _, err := w.Write([]byte("line\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("writing output waited %v for the syslog server", elapsed)
+	}
+	if err := conn.send([]byte("dropped")); err != errSyslogQueueFull {
+		t.Errorf("messages beyond the queue are not dropped: %v", err)
+	}
+}
+
+func TestSyslogWriterTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := getSyslogConn("tcp://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &syslogWriter{conn: conn, tag: "test", command: "echo", id: "42", stream: "stdout", severity: 6, log: zap.NewNop()}
+	w.Write([]byte("hello\nwor"))
+	w.Write([]byte("ld"))
+	w.flush()
+
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(server)
+	for _, want := range []string{"hello", "world"} {
+		// octet counting framing
+		length, err := r.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(msg), "<14>1 ") || !strings.HasSuffix(string(msg), `[exec@32473 command="echo" id="42"] `+want) {
+			t.Errorf("unexpected message %q", msg)
+		}
+	}
+}